@@ -2,109 +2,231 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 func main() {
-	var wg sync.WaitGroup
-	wg.Add(2)
+	addr := flag.String("addr", "localhost:5000", "адрес сервера")
+	clients := flag.Int("clients", 4, "количество одновременных клиентов")
+	user := flag.String("user", "", "имя пользователя, если сервер требует вход")
+	password := flag.String("password", os.Getenv("BOOKS_PASSWORD"), "пароль (по умолчанию из BOOKS_PASSWORD)")
+	useTLS := flag.Bool("tls", false, "подключаться по TLS")
+	caFile := flag.String("ca", "", "сертификаты CA для проверки сервера (включает TLS; по умолчанию системные)")
+	certFile := flag.String("cert", "", "клиентский сертификат в формате PEM")
+	keyFile := flag.String("key", "", "закрытый ключ клиентского сертификата")
+	flag.Parse()
 
-	// Клиент 1
-	go func() {
-		defer wg.Done()
-		conn, err := net.Dial("tcp", "localhost:5000")
-		if err != nil {
-			fmt.Printf("Клиент 1: ошибка подключения: %v\n", err)
-			return
+	var tlsConfig *tls.Config
+	if *useTLS || *caFile != "" || *certFile != "" {
+		var err error
+		if tlsConfig, err = clientTLSConfig(*addr, *caFile, *certFile, *keyFile); err != nil {
+			fmt.Printf("Ошибка настройки TLS: %v\n", err)
+			os.Exit(1)
 		}
-		defer conn.Close()
+	}
+
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	var forbidden atomic.Bool
+	for i := 1; i <= *clients; i++ {
+		wg.Add(1)
+		go func(clientName string) {
+			defer wg.Done()
+			conn, err := dial(*addr, tlsConfig)
+			if err != nil {
+				fmt.Printf("%s: ошибка подключения: %v\n", clientName, err)
+				failed.Add(1)
+				return
+			}
+			defer conn.Close()
+
+			// Имя и пароль отправляются сразу: сервер прочитает их в ответ на приглашение
+			if *user != "" {
+				fmt.Fprintf(conn, "%s\n%s\n", *user, *password)
+			}
+			if err := addTestBook(conn, clientName); err != nil {
+				failed.Add(1)
+				if errors.Is(err, errForbidden) {
+					forbidden.Store(true)
+				}
+			}
+		}(fmt.Sprintf("Клиент %d", i))
+	}
 
-		addTestBook(conn, "Клиент 1")
-	}()
+	wg.Wait()
+	if forbidden.Load() {
+		fmt.Println("Сервер не разрешил добавить книгу: нужен пользователь с ролью editor или admin.")
+		fmt.Println("Добавьте его командой crud_in_txt useradd -role editor имя и передайте -user и -password")
+	}
+	if n := failed.Load(); n > 0 {
+		fmt.Printf("Клиентов с ошибками: %d из %d\n", n, *clients)
+		os.Exit(1)
+	}
+	fmt.Printf("Все клиенты (%d) завершили работу\n", *clients)
+}
 
-	// Клиент 2
-	go func() {
-		defer wg.Done()
-		conn, err := net.Dial("tcp", "localhost:5000")
+// clientTLSConfig trusts the CAs from caFile instead of the system ones when
+// it is set, and presents certFile when the server asks for a client certificate
+func clientTLSConfig(addr, caFile, certFile, keyFile string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
 		if err != nil {
-			fmt.Printf("Клиент 2: ошибка подключения: %v\n", err)
-			return
+			return nil, err
 		}
-		defer conn.Close()
-
-		addTestBook(conn, "Клиент 2")
-	}()
-	// Клиент 3
-	go func() {
-		defer wg.Done()
-		conn, err := net.Dial("tcp", "localhost:5000")
-		if err != nil {
-			fmt.Printf("Клиент 3: ошибка подключения: %v\n", err)
-			return
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("в %s нет сертификатов в формате PEM", caFile)
 		}
-		defer conn.Close()
-
-		addTestBook(conn, "Клиент 3")
-	}()
-	// Клиент 4
-	go func() {
-		defer wg.Done()
-		conn, err := net.Dial("tcp", "localhost:5000")
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 		if err != nil {
-			fmt.Printf("Клиент 4: ошибка подключения: %v\n", err)
-			return
+			return nil, err
 		}
-		defer conn.Close()
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
 
-		addTestBook(conn, "Клиент 4")
-	}()
+// dial connects in plain text, or over TLS when config is not nil. The TLS
+// handshake is done right away so certificate errors show up as connection errors
+func dial(addr string, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		return net.Dial("tcp", addr)
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
 
-	wg.Wait()
-	fmt.Println("Оба клиента завершили работу")
+// errForbidden is returned by addTestBook when the server refuses the create
+// because the session's role may only read
+var errForbidden = errors.New("недостаточно прав")
+
+// errFailed is returned by addTestBook for any other failure
+var errFailed = errors.New("ошибка клиента")
+
+type response struct {
+	Status string          `json:"status"`
+	Code   string          `json:"code"`
+	Error  string          `json:"error"`
+	Field  string          `json:"field"`
+	Data   json.RawMessage `json:"data"`
 }
-func addTestBook(conn net.Conn, clientName string) {
-	currentYear := time.Now().Year()
-	book := []string{
-		"1", // Create
-		"1", // Ввести книгу
-		fmt.Sprintf("Тестовая книга от %s %s", clientName, time.Now().Format("150405")),
-		"Автор ",
-		"Жанр, ЖанрН",
-		fmt.Sprintf("%d", currentYear-1),
-		"150",
-		"200",
-		"твердый",
-		"покупка",
-		time.Now().Format("02-01-2006"),
-		"",
-		"8/10 - Хорошая книга",
-		"д", // Подтверждение отправляется автоматически
-	}
-
-	// Сначала отправляем все данные
-	for _, line := range book {
-		fmt.Printf("[%s] Отправка: %s\n", clientName, line)
-		fmt.Fprintf(conn, line+"\n")
-		time.Sleep(100 * time.Millisecond)
-	}
-
-	// Затем ждем ответа от сервера
-	scanner := bufio.NewScanner(conn)
+
+// readResponse skips the menu text sent before the handshake and returns the next JSON line
+func readResponse(scanner *bufio.Scanner) (response, error) {
 	for scanner.Scan() {
-		response := scanner.Text()
-		fmt.Printf("[%s] Ответ сервера: %s\n", clientName, response)
-		if strings.Contains(response, "успешно") { // Или другой маркер завершения
-			break
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "{") {
+			continue
 		}
+		var resp response
+		err := json.Unmarshal([]byte(line), &resp)
+		return resp, err
 	}
-
 	if err := scanner.Err(); err != nil {
+		return response{}, err
+	}
+	return response{}, fmt.Errorf("соединение закрыто сервером")
+}
+
+// addTestBook creates a book and then reads the whole list back, checking
+// that the new book is there and every other client's response was consistent.
+// The error has been printed already; a refused create is errForbidden
+func addTestBook(conn net.Conn, clientName string) error {
+	currentYear := time.Now().Year()
+	scanner := bufio.NewScanner(conn)
+
+	// Переключаемся в режим JSON
+	fmt.Fprintln(conn, "json")
+	if _, err := readResponse(scanner); err != nil {
+		fmt.Printf("[%s] Ошибка рукопожатия: %v\n", clientName, err)
+		return errFailed
+	}
+
+	request, _ := json.Marshal(map[string]interface{}{
+		"op": "create",
+		"book": map[string]string{
+			"name":    fmt.Sprintf("Тестовая книга от %s %s", clientName, time.Now().Format("150405")),
+			"authors": "Автор ",
+			"genres":  "Жанр, ЖанрН",
+			"year":    fmt.Sprintf("%d", currentYear-1),
+			"width":   "150",
+			"height":  "200",
+			"cover":   "твердый",
+			"source":  "покупка",
+			"added":   time.Now().Format("02-01-2006"),
+			"score":   "8",
+			"review":  "Хорошая книга",
+		},
+	})
+	fmt.Printf("[%s] Отправка: %s\n", clientName, request)
+	fmt.Fprintf(conn, "%s\n", request)
+
+	resp, err := readResponse(scanner)
+	if err != nil {
 		fmt.Printf("[%s] Ошибка чтения: %v\n", clientName, err)
+		return errFailed
+	}
+	if resp.Status != "ok" {
+		fmt.Printf("[%s] Ошибка сервера (%s %s): %s\n", clientName, resp.Code, resp.Field, resp.Error)
+		if resp.Code == "forbidden" {
+			return errForbidden
+		}
+		return errFailed
+	}
+	fmt.Printf("[%s] Ответ сервера: %s\n", clientName, resp.Data)
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(resp.Data, &created)
+
+	// Читаем список книг параллельно с другими клиентами
+	fmt.Fprintln(conn, `{"op":"read"}`)
+	resp, err = readResponse(scanner)
+	if err != nil || resp.Status != "ok" {
+		fmt.Printf("[%s] Ошибка чтения списка: %v %s\n", clientName, err, resp.Error)
+		return errFailed
+	}
+	var books []struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(resp.Data, &books); err != nil {
+		fmt.Printf("[%s] Некорректный список книг: %v\n", clientName, err)
+		return errFailed
+	}
+	found := false
+	for _, book := range books {
+		if book.ID == created.ID {
+			found = true
+		}
+	}
+	if !found {
+		fmt.Printf("[%s] Добавленная книга %s не найдена в списке\n", clientName, created.ID)
+		return errFailed
 	}
 
+	fmt.Fprintln(conn, `{"op":"exit"}`)
 	fmt.Printf("[%s] Завершил работу\n", clientName)
+	return nil
 }
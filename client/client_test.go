@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testPKI is a CA with a server and a client certificate, as PEM files
+// generated by testdata/pki/gen.go in the repository root
+type testPKI struct {
+	caPath                string
+	serverCert, serverKey string
+	clientCert, clientKey string
+}
+
+func newTestPKI() testPKI {
+	dir := filepath.Join("..", "testdata", "pki")
+	return testPKI{
+		caPath:     filepath.Join(dir, "books-ca.pem"),
+		serverCert: filepath.Join(dir, "server.pem"),
+		serverKey:  filepath.Join(dir, "server.key"),
+		clientCert: filepath.Join(dir, "client.pem"),
+		clientKey:  filepath.Join(dir, "client.key"),
+	}
+}
+
+// startServer accepts TLS connections that present a client certificate
+// signed by the test CA and greets each of them with one line
+func startServer(t *testing.T, pki testPKI) string {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(pki.serverCert, pki.serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(pki.caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(data)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("привет\n"))
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestClientTLSWithCustomCA(t *testing.T) {
+	pki := newTestPKI()
+	addr := startServer(t, pki)
+
+	config, err := clientTLSConfig(addr, pki.caPath, pki.clientCert, pki.clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial(addr, config)
+	if err != nil {
+		t.Fatalf("подключение с -ca: %v", err)
+	}
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "привет\n" {
+		t.Errorf("ответ сервера %q, %v", line, err)
+	}
+
+	// Без -ca сертификат сервера проверяется по системным CA и не проходит
+	config, err = clientTLSConfig(addr, "", pki.clientCert, pki.clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := dial(addr, config); err == nil {
+		conn.Close()
+		t.Error("сертификат сервера от неизвестного CA принят")
+	}
+}
+
+func TestClientTLSConfigErrors(t *testing.T) {
+	pki := newTestPKI()
+	cases := []struct{ addr, ca, cert, key string }{
+		{"127.0.0.1", pki.caPath, "", ""},
+		{"127.0.0.1:5000", filepath.Join(t.TempDir(), "missing.pem"), "", ""},
+		{"127.0.0.1:5000", pki.clientKey, "", ""},
+		{"127.0.0.1:5000", pki.caPath, pki.clientCert, ""},
+	}
+	for _, c := range cases {
+		if _, err := clientTLSConfig(c.addr, c.ca, c.cert, c.key); err == nil {
+			t.Errorf("настройки %+v приняты", c)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// serverConfig holds every setting of the server. Each one can come from the
+// JSON config file, an environment variable or a flag, in increasing order of
+// priority. The names match: flag "lock-timeout", JSON key "lock_timeout",
+// environment variable BOOKS_LOCK_TIMEOUT
+type serverConfig struct {
+	Listen     string `json:"listen"`
+	HTTPListen string `json:"http_listen"`
+	DataDir    string `json:"data_dir"`
+	Database   string `json:"database"`
+	TempFile   string `json:"temp_file"`
+	UsersFile  string `json:"users"`
+
+	MinYear      int     `json:"min_year"`
+	MaxCoverSize float64 `json:"max_cover_size"`
+
+	CreateDelay    duration `json:"create_delay"`
+	LockTimeout    duration `json:"lock_timeout"`
+	TrashRetention duration `json:"trash_retention"`
+	// ShutdownTimeout is how long a shutdown waits for sessions to finish
+	ShutdownTimeout duration `json:"shutdown_timeout"`
+	// IdleTimeout closes a session that sends nothing for that long; 0 never does
+	IdleTimeout duration `json:"idle_timeout"`
+
+	// Ограничения числа соединений; 0 - без ограничения
+	MaxConnections int `json:"max_connections"`
+	MaxPerIP       int `json:"max_per_ip"`
+	// MaxBodySize caps the body of an HTTP request, in bytes
+	MaxBodySize int64 `json:"max_body_size"`
+
+	HTTP    bool `json:"http"`
+	History bool `json:"history"`
+
+	TLSCert     string `json:"tls_cert"`
+	TLSKey      string `json:"tls_key"`
+	TLSClientCA string `json:"tls_client_ca"`
+}
+
+func defaultConfig() serverConfig {
+	return serverConfig{
+		Listen:          ":5000",
+		HTTPListen:      ":8080",
+		DataDir:         ".",
+		Database:        FILENAME,
+		TempFile:        tempFilename,
+		MinYear:         1500,
+		MaxCoverSize:    1000,
+		LockTimeout:     duration(5 * time.Second),
+		ShutdownTimeout: duration(10 * time.Second),
+		IdleTimeout:     duration(15 * time.Minute),
+		MaxConnections:  100,
+		MaxPerIP:        10,
+		MaxBodySize:     10 << 20,
+		HTTP:            true,
+		History:         true,
+	}
+}
+
+// config is the configuration in effect; the flags write straight into it
+var config = defaultConfig()
+
+// configPath is the JSON config file, set by -config or BOOKS_CONFIG
+var configPath string
+
+// printConfig makes the server print the configuration in effect and exit
+var printConfig bool
+
+const envPrefix = "BOOKS_"
+
+// duration is a time.Duration written as "5s" in JSON and flags
+type duration time.Duration
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *duration) Set(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("длительность записывается строкой, например \"5s\"")
+	}
+	return d.Set(value)
+}
+
+// defineFlags registers a flag for every setting of serverConfig
+func defineFlags() {
+	flag.StringVar(&configPath, "config", "", "файл настроек в формате JSON (также BOOKS_CONFIG)")
+	flag.BoolVar(&printConfig, "print-config", false, "вывести действующие настройки и выйти")
+
+	flag.StringVar(&config.Listen, "listen", config.Listen, "адрес TCP сервера")
+	flag.StringVar(&config.HTTPListen, "http-listen", config.HTTPListen, "адрес HTTP API")
+	flag.StringVar(&config.DataDir, "data-dir", config.DataDir, "каталог с базой и служебными файлами")
+	flag.StringVar(&config.Database, "database", config.Database, "имя файла базы в каталоге данных")
+	flag.StringVar(&config.TempFile, "temp-file", config.TempFile, "имя временного файла для перезаписи базы")
+	flag.StringVar(&config.UsersFile, "users", config.UsersFile, "файл учетных записей (по умолчанию <база>.users; пока он пуст, вход не требуется)")
+
+	flag.IntVar(&config.MinYear, "min-year", config.MinYear, "наименьший допустимый год издания")
+	flag.Float64Var(&config.MaxCoverSize, "max-cover-size", config.MaxCoverSize, "наибольшая ширина и высота обложки, мм")
+
+	flag.Var(&config.CreateDelay, "create-delay", "искусственная задержка при добавлении книги (для демонстрации блокировки)")
+	flag.Var(&config.LockTimeout, "lock-timeout", "сколько ждать освобождения базы данных другим процессом")
+	flag.Var(&config.TrashRetention, "trash-retention", "сколько хранить удаленные книги в корзине (0 - пока не удалят вручную)")
+	flag.Var(&config.ShutdownTimeout, "shutdown-timeout", "сколько ждать завершения начатых операций при остановке сервера")
+	flag.Var(&config.IdleTimeout, "idle-timeout", "закрывать сеанс, если клиент ничего не присылает столько времени (0 - не закрывать)")
+	flag.IntVar(&config.MaxConnections, "max-connections", config.MaxConnections, "наибольшее число одновременных соединений (0 - без ограничения)")
+	flag.IntVar(&config.MaxPerIP, "max-per-ip", config.MaxPerIP, "наибольшее число соединений с одного адреса (0 - без ограничения)")
+	flag.Int64Var(&config.MaxBodySize, "max-body-size", config.MaxBodySize, "наибольший размер тела HTTP-запроса, байт")
+
+	flag.BoolVar(&config.HTTP, "http", config.HTTP, "включить HTTP API")
+	flag.BoolVar(&config.History, "history", config.History, "записывать историю изменений книг")
+
+	flag.StringVar(&config.TLSCert, "tls-cert", config.TLSCert, "сертификат сервера в формате PEM (включает TLS)")
+	flag.StringVar(&config.TLSKey, "tls-key", config.TLSKey, "закрытый ключ сервера в формате PEM")
+	flag.StringVar(&config.TLSClientCA, "tls-client-ca", config.TLSClientCA, "сертификаты CA для проверки клиентских сертификатов (требует их от всех клиентов)")
+}
+
+// envName returns the environment variable for a flag: lock-timeout -> BOOKS_LOCK_TIMEOUT
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig builds the configuration after flag.Parse: defaults, then the
+// config file, then the environment, then the flags given on the command line
+func loadConfig() error {
+	explicit := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	config = defaultConfig()
+	if configPath == "" {
+		configPath = os.Getenv(envPrefix + "CONFIG")
+	}
+	if configPath != "" {
+		if err := readConfigFile(configPath, &config); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("неверное значение %s=%q: %v", envName(f.Name), value, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for name, value := range explicit {
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("неверное значение -%s=%q: %v", name, value, err)
+		}
+	}
+
+	if err := config.validate(); err != nil {
+		return err
+	}
+	if config.UsersFile == "" {
+		config.UsersFile = config.databasePath() + ".users"
+	}
+	config.apply()
+	return nil
+}
+
+func readConfigFile(path string, into *serverConfig) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия файла настроек: %v", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(into); err != nil {
+		return fmt.Errorf("ошибка в файле настроек %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c serverConfig) validate() error {
+	switch {
+	case c.Listen == "":
+		return fmt.Errorf("не задан адрес TCP сервера (listen)")
+	case c.HTTP && c.HTTPListen == "":
+		return fmt.Errorf("не задан адрес HTTP API (http_listen)")
+	case c.Database == "" || c.TempFile == "":
+		return fmt.Errorf("не заданы имена файлов базы (database, temp_file)")
+	case c.MinYear <= 0:
+		return fmt.Errorf("min_year должен быть положительным")
+	case c.MinYear > time.Now().Year():
+		return fmt.Errorf("min_year не может быть больше текущего года")
+	case c.MaxCoverSize <= 0:
+		return fmt.Errorf("max_cover_size должен быть положительным")
+	case c.LockTimeout < 0 || c.CreateDelay < 0 || c.TrashRetention < 0 || c.ShutdownTimeout < 0 || c.IdleTimeout < 0:
+		return fmt.Errorf("длительности не могут быть отрицательными")
+	case c.MaxConnections < 0 || c.MaxPerIP < 0:
+		return fmt.Errorf("ограничения числа соединений не могут быть отрицательными")
+	case c.MaxBodySize <= 0:
+		return fmt.Errorf("max_body_size должен быть положительным")
+	}
+	return nil
+}
+
+// databasePath returns the database file inside the data directory
+func (c serverConfig) databasePath() string {
+	return filepath.Join(c.DataDir, c.Database)
+}
+
+// apply hands the settings to the parts of the server that use them
+func (c serverConfig) apply() {
+	path := c.databasePath()
+	store = newFileStore(path, filepath.Join(c.DataDir, c.TempFile))
+	useDataFiles(path, c.UsersFile)
+
+	createDelay = time.Duration(c.CreateDelay)
+	lockTimeout = time.Duration(c.LockTimeout)
+	trashRetention = time.Duration(c.TrashRetention)
+	tlsCertFile, tlsKeyFile, tlsClientCA = c.TLSCert, c.TLSKey, c.TLSClientCA
+}
+
+// useDataFiles keeps the history and the trash next to path, whatever the
+// store is, and the accounts in usersFile
+func useDataFiles(path, usersFile string) {
+	history = &changeLog{path: path + ".history"}
+	trash = &trashBin{path: path + ".trash"}
+	usersPath = usersFile
+}
+
+// writeConfig prints the configuration in effect as a config file
+func writeConfig(c serverConfig) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// loadTestConfig runs loadConfig over a config file with the given JSON and
+// a command line of args, as main does. Everything loadConfig changes is
+// restored when the test ends
+func loadTestConfig(t *testing.T, fileJSON string, args ...string) (serverConfig, error) {
+	t.Helper()
+	silenceLog(t)
+	savedFlags, savedPath, savedConfig := flag.CommandLine, configPath, config
+	savedStore, savedHistory, savedTrash, savedUsers := store, history, trash, usersPath
+	savedDelay, savedLock, savedRetention := createDelay, lockTimeout, trashRetention
+	savedCert, savedKey, savedCA := tlsCertFile, tlsKeyFile, tlsClientCA
+	t.Cleanup(func() {
+		flag.CommandLine, configPath, config = savedFlags, savedPath, savedConfig
+		store, history, trash, usersPath = savedStore, savedHistory, savedTrash, savedUsers
+		createDelay, lockTimeout, trashRetention = savedDelay, savedLock, savedRetention
+		tlsCertFile, tlsKeyFile, tlsClientCA = savedCert, savedKey, savedCA
+	})
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(fileJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envPrefix+"CONFIG", path)
+
+	flag.CommandLine = flag.NewFlagSet("crud_in_txt", flag.ContinueOnError)
+	configPath = ""
+	config = defaultConfig()
+	defineFlags()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	err := loadConfig()
+	return config, err
+}
+
+// TestConfigPrecedence checks that a flag beats the environment, the
+// environment beats the config file and the file beats the defaults
+func TestConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("BOOKS_LISTEN", ":6002")
+	t.Setenv("BOOKS_LOCK_TIMEOUT", "8s")
+
+	got, err := loadTestConfig(t, `{
+		"data_dir": "`+dir+`",
+		"listen": ":6001",
+		"lock_timeout": "7s",
+		"min_year": 1600
+	}`, "-listen", ":6003")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Listen != ":6003" {
+		t.Errorf("listen %q: флаг должен перекрывать окружение и файл", got.Listen)
+	}
+	if got.LockTimeout != duration(8*time.Second) || lockTimeout != 8*time.Second {
+		t.Errorf("lock_timeout %v: окружение должно перекрывать файл", got.LockTimeout)
+	}
+	if got.MinYear != 1600 {
+		t.Errorf("min_year %d: файл должен перекрывать значение по умолчанию", got.MinYear)
+	}
+	if got.MaxPerIP != defaultConfig().MaxPerIP {
+		t.Errorf("max_per_ip %d: должно остаться значение по умолчанию", got.MaxPerIP)
+	}
+	if want := filepath.Join(dir, FILENAME) + ".users"; got.UsersFile != want {
+		t.Errorf("users %q, ожидалось %q", got.UsersFile, want)
+	}
+}
+
+// TestConfigRejected checks that loadConfig refuses invalid settings from
+// any source
+func TestConfigRejected(t *testing.T) {
+	cases := []struct {
+		name     string
+		fileJSON string
+		env      map[string]string
+		args     []string
+	}{
+		{name: "отрицательное max_connections", fileJSON: `{"max_connections": -1}`},
+		{name: "отрицательное max_per_ip", env: map[string]string{"BOOKS_MAX_PER_IP": "-2"}},
+		{name: "отрицательная длительность", args: []string{"-idle-timeout", "-1s"}},
+		{name: "нулевой max_body_size", fileJSON: `{"max_body_size": 0}`},
+		{name: "min_year больше текущего года", args: []string{"-min-year", strconv.Itoa(time.Now().Year() + 1)}},
+		{name: "пустой listen", fileJSON: `{"listen": ""}`},
+		{name: "пустой http_listen", args: []string{"-http-listen", ""}},
+		{name: "неизвестный ключ", fileJSON: `{"port": 5000}`},
+		{name: "неверная длительность в окружении", env: map[string]string{"BOOKS_LOCK_TIMEOUT": "5 секунд"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for name, value := range c.env {
+				t.Setenv(name, value)
+			}
+			fileJSON := c.fileJSON
+			if fileJSON == "" {
+				fileJSON = "{}"
+			}
+			if got, err := loadTestConfig(t, fileJSON, c.args...); err == nil {
+				t.Errorf("настройки приняты: %+v", got)
+			}
+		})
+	}
+}
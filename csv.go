@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// errInvalidCSV is returned when a CSV file can't be imported at all
+var errInvalidCSV = errors.New("некорректный CSV")
+
+// exportCSV writes books as RFC 4180 CSV with a header row of field names
+func exportCSV(w io.Writer, books []Book) error {
+	writer := csv.NewWriter(w)
+	writer.UseCRLF = true
+
+	if err := writer.Write(bookFields); err != nil {
+		return fmt.Errorf("ошибка записи CSV: %v", err)
+	}
+	for _, book := range books {
+		record := make([]string, len(bookFields))
+		for i, field := range bookFields {
+			record[i] = book.getField(field)
+		}
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("ошибка записи CSV: %v", err)
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("ошибка записи CSV: %v", err)
+	}
+	return nil
+}
+
+// parseCSVMapping parses "Название=name,Автор=authors" into column -> field.
+// Besides the book fields a column may map to "rating", an "X/10 - отзыв"
+// value that is split into score and review
+func parseCSVMapping(spec string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	if strings.TrimSpace(spec) == "" {
+		return mapping, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		column, field, ok := strings.Cut(pair, "=")
+		column = strings.ToLower(strings.TrimSpace(column))
+		field = strings.ToLower(strings.TrimSpace(field))
+		if !ok || column == "" {
+			return nil, fmt.Errorf("неверное сопоставление %q, ожидается колонка=поле", pair)
+		}
+		if !contains(bookFields, field) && field != "rating" {
+			return nil, fmt.Errorf("неизвестное поле %q в сопоставлении", field)
+		}
+		mapping[column] = field
+	}
+	return mapping, nil
+}
+
+// importRow is the outcome of importing one CSV row or dumped book. Line is
+// the line of the CSV file or the position of the book in the dump
+type importRow struct {
+	Line   int    `json:"line"`
+	Status string `json:"status"` // accepted, rejected или duplicate
+	ID     string `json:"id,omitempty"`
+	Field  string `json:"field,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// importReport lists the outcome of every row of an import
+type importReport struct {
+	Accepted   int         `json:"accepted"`
+	Rejected   int         `json:"rejected"`
+	Duplicates int         `json:"duplicates"`
+	Rows       []importRow `json:"rows"`
+}
+
+func (r *importReport) add(row importRow) {
+	switch row.Status {
+	case "accepted":
+		r.Accepted++
+	case "rejected":
+		r.Rejected++
+	case "duplicate":
+		r.Duplicates++
+	}
+	r.Rows = append(r.Rows, row)
+}
+
+// importCSV adds a book for every row of a CSV file with a header row.
+// Columns are matched to fields by mapping and then by field name; the id
+// column is ignored since books get new IDs. Every row is validated and
+// checked for duplicates like a book created from the menu, and a bad row
+// doesn't stop the import. client is recorded in the history of new books
+func importCSV(r io.Reader, mapping map[string]string, client string) (importReport, error) {
+	var report importReport
+
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return report, fmt.Errorf("%w: пустой файл", errInvalidCSV)
+	}
+	if err != nil {
+		return report, fmt.Errorf("%w: ошибка чтения заголовка: %v", errInvalidCSV, err)
+	}
+
+	columns := make([]string, len(header))
+	mapped := 0
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		field, ok := mapping[name]
+		if !ok && (contains(bookFields, name) || name == "rating") {
+			field = name
+		}
+		if field != "" && field != "id" {
+			columns[i] = field
+			mapped++
+		}
+	}
+	if mapped == 0 {
+		return report, fmt.Errorf("%w: ни одна колонка не сопоставлена с полем книги", errInvalidCSV)
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			report.add(importRow{Line: parseErr.StartLine, Status: "rejected", Error: csvProblem(parseErr.Err)})
+			continue
+		}
+		if err != nil {
+			return report, fmt.Errorf("ошибка чтения CSV: %v", err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		values := make(map[string]string)
+		for i, value := range record {
+			if columns[i] == "rating" {
+				values["score"], values["review"] = splitRating(value)
+			} else if columns[i] != "" {
+				values[columns[i]] = value
+			}
+		}
+		book := Book{
+			Name:    values["name"],
+			Authors: values["authors"],
+			Genres:  values["genres"],
+			Year:    values["year"],
+			Width:   values["width"],
+			Height:  values["height"],
+			Cover:   values["cover"],
+			Source:  values["source"],
+			Added:   values["added"],
+			Read:    values["read"],
+			Score:   values["score"],
+			Review:  values["review"],
+		}
+
+		row := importRow{Line: line}
+		book, err = validateBook(book)
+		if err == nil {
+			book, err = createBook(book, client)
+		}
+		var fieldErr *FieldError
+		switch {
+		case err == nil:
+			row.Status, row.ID = "accepted", book.ID
+		case errors.As(err, &fieldErr):
+			row.Status, row.Field, row.Error = "rejected", fieldErr.Field, fieldErr.Err.Error()
+		case errors.Is(err, errBookExists):
+			row.Status, row.Error = "duplicate", err.Error()
+		default:
+			return report, err
+		}
+		report.add(row)
+	}
+	return report, nil
+}
+
+func csvProblem(err error) string {
+	switch {
+	case errors.Is(err, csv.ErrFieldCount):
+		return "число колонок не совпадает с заголовком"
+	case errors.Is(err, csv.ErrQuote), errors.Is(err, csv.ErrBareQuote):
+		return "лишняя или незакрытая кавычка"
+	}
+	return err.Error()
+}
+
+// runExport implements the "export [-q запрос] [-o файл]" command
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	query := fs.String("q", "", "выгрузить только книги, подходящие под запрос")
+	output := fs.String("o", "", "файл для записи (по умолчанию стандартный вывод)")
+	fs.Parse(args)
+
+	var books []Book
+	var err error
+	if *query != "" {
+		var q Query
+		if q, err = ParseQuery(*query); err != nil {
+			fmt.Fprintf(os.Stderr, "Ошибка в запросе: %v\n", err)
+			return 2
+		}
+		books, err = queryBooks(q)
+	} else {
+		books, err = Read()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ошибка: %v\n", err)
+		return 2
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintf(os.Stderr, "Ошибка: %v\n", err)
+			return 2
+		}
+		defer out.Close()
+	}
+	if err := exportCSV(out, books); err != nil {
+		fmt.Fprintf(os.Stderr, "Ошибка: %v\n", err)
+		return 2
+	}
+	if *output != "" {
+		fmt.Printf("Выгружено книг: %d\n", len(books))
+	}
+	return 0
+}
+
+// runImport implements the "import [-map колонка=поле,...] файл.csv" command.
+// The exit code is 1 if some rows were not imported
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	spec := fs.String("map", "", "сопоставление колонок с полями: Название=name,Автор=authors")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println("Использование: import [-map колонка=поле,...] файл.csv")
+		return 2
+	}
+
+	mapping, err := parseCSVMapping(*spec)
+	if err != nil {
+		fmt.Printf("Ошибка: %v\n", err)
+		return 2
+	}
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Ошибка: %v\n", err)
+		return 2
+	}
+	defer file.Close()
+
+	report, err := importCSV(file, mapping, "cli:import")
+	if len(report.Rows) > 0 {
+		fmt.Print(formatImportReport(report, "строка"))
+	}
+	if err != nil {
+		fmt.Printf("Импорт прерван: %v\n", err)
+		return 2
+	}
+	if report.Rejected > 0 || report.Duplicates > 0 {
+		return 1
+	}
+	return 0
+}
+
+// formatImportReport lists every row; unit names what Line counts
+func formatImportReport(report importReport, unit string) string {
+	var builder strings.Builder
+	for _, row := range report.Rows {
+		switch row.Status {
+		case "accepted":
+			builder.WriteString(fmt.Sprintf("%s %d: добавлена, ID %s\n", unit, row.Line, row.ID))
+		case "duplicate":
+			builder.WriteString(fmt.Sprintf("%s %d: дубликат: %s\n", unit, row.Line, row.Error))
+		default:
+			if row.Field != "" {
+				builder.WriteString(fmt.Sprintf("%s %d: отклонена: поле %s: %s\n", unit, row.Line, row.Field, row.Error))
+			} else {
+				builder.WriteString(fmt.Sprintf("%s %d: отклонена: %s\n", unit, row.Line, row.Error))
+			}
+		}
+	}
+	builder.WriteString(fmt.Sprintf("Добавлено: %d, отклонено: %d, дубликатов: %d\n",
+		report.Accepted, report.Rejected, report.Duplicates))
+	return builder.String()
+}
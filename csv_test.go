@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestImportCSVReport imports a file with mapped columns and a few bad rows
+// and checks the report and the books that were added
+func TestImportCSVReport(t *testing.T) {
+	existing := newTestBook("Существующая книга")
+	existing.ID = "1"
+	useMemoryDatabase(t, existing)
+
+	input := strings.Join([]string{
+		"\ufeffНазвание,Автор,genres,year,width,height,cover,source,added,Рейтинг,id",
+		`"Книга, с запятой",Тестовый Автор,Роман,2000,100,200,мягкий,покупка,01-01-2020,8/10 - отличная,99`,
+		"Книга из будущего,Тестовый Автор,Роман,3000,100,200,мягкий,покупка,01-01-2020,,",
+		"Существующая книга,Тестовый Автор,Роман,2000,100,200,мягкий,покупка,01-01-2020,,",
+		"Обрезанная строка,Тестовый Автор",
+		"Без оценки,Тестовый Автор,Роман,2000,100,200,мягкий,покупка,01-01-2020,понравилась,5",
+	}, "\r\n") + "\r\n"
+	mapping, err := parseCSVMapping("Название=name, Автор=authors, Рейтинг=rating")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := importCSV(strings.NewReader(input), mapping, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []importRow{
+		{Line: 2, Status: "accepted", ID: "2"},
+		{Line: 3, Status: "rejected", Field: "year"},
+		{Line: 4, Status: "duplicate"},
+		{Line: 5, Status: "rejected"},
+		{Line: 6, Status: "accepted", ID: "3"},
+	}
+	if len(report.Rows) != len(want) {
+		t.Fatalf("в отчете %d строк, ожидалось %d: %+v", len(report.Rows), len(want), report.Rows)
+	}
+	for i, row := range report.Rows {
+		w := want[i]
+		if row.Line != w.Line || row.Status != w.Status || row.ID != w.ID || row.Field != w.Field {
+			t.Errorf("строка отчета %d: %+v, ожидалось %+v", i+1, row, w)
+		}
+		if row.Status != "accepted" && row.Error == "" {
+			t.Errorf("строка %d отклонена без описания ошибки", row.Line)
+		}
+	}
+	if report.Accepted != 2 || report.Rejected != 2 || report.Duplicates != 1 {
+		t.Errorf("итоги отчета %d/%d/%d, ожидалось 2/2/1", report.Accepted, report.Rejected, report.Duplicates)
+	}
+
+	imported, err := store.Get("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Name != "Книга, с запятой" || imported.Score != "8" || imported.Review != "отличная" {
+		t.Errorf("импортирована %+v", imported)
+	}
+	if book, err := store.Get("3"); err != nil || book.Score != "" || book.Review != "понравилась" {
+		t.Errorf("рейтинг без оценки: %+v, %v", book, err)
+	}
+}
+
+// TestImportCSVErrors checks the files and mappings that can't be imported at all
+func TestImportCSVErrors(t *testing.T) {
+	useMemoryDatabase(t)
+	for _, input := range []string{"", "Колонка,Другая\r\nа,б\r\n", "id\r\n1\r\n"} {
+		if _, err := importCSV(strings.NewReader(input), nil, "test"); !errors.Is(err, errInvalidCSV) {
+			t.Errorf("%q: %v, ожидалось %v", input, err, errInvalidCSV)
+		}
+	}
+	for _, spec := range []string{"Название", "=name", "Название=publisher"} {
+		if _, err := parseCSVMapping(spec); err == nil {
+			t.Errorf("сопоставление %q принято", spec)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// databaseDump is a lossless copy of the whole database for backups and for
+// moving books between servers
+type databaseDump struct {
+	Format int    `json:"format"`
+	LastID int    `json:"last_id"`
+	Books  []Book `json:"books"`
+}
+
+// Режимы восстановления дампа
+const (
+	// restoreMerge adds the dumped books to the existing ones under new IDs
+	restoreMerge = "merge"
+	// restoreReplace replaces every book with the dumped ones, keeping their IDs
+	restoreReplace = "replace"
+)
+
+// errDumpRejected is returned when a dump fails the checks in replace mode
+// and nothing has been changed
+var errDumpRejected = errors.New("дамп не прошел проверку, база не изменена")
+
+func dumpDatabase() (databaseDump, error) {
+	unlock, err := lockDB(false)
+	if err != nil {
+		return databaseDump{}, err
+	}
+	defer unlock()
+
+	books, err := store.List()
+	if err != nil {
+		return databaseDump{}, err
+	}
+	dump := databaseDump{Format: currentFormat, Books: nonNilBooks(books)}
+	if seq, ok := store.(sequenced); ok {
+		if dump.LastID, err = seq.LastID(); err != nil {
+			return databaseDump{}, err
+		}
+	}
+	return dump, nil
+}
+
+// restoreDatabase loads a dump. Every book goes through validateBook and the
+// uniqueness rules; the report lists each book by its position in the dump
+func restoreDatabase(dump databaseDump, mode, client string) (importReport, error) {
+	if dump.Format == 0 {
+		return importReport{}, fmt.Errorf("в дампе не указана версия формата")
+	}
+	if err := checkFormatVersion(dump.Format); err != nil {
+		return importReport{}, err
+	}
+
+	switch mode {
+	case restoreMerge:
+		return mergeDump(dump, client)
+	case restoreReplace:
+		return replaceWithDump(dump, client)
+	}
+	return importReport{}, fmt.Errorf("неизвестный режим восстановления %q, ожидается %s или %s", mode, restoreMerge, restoreReplace)
+}
+
+// mergeDump adds the books one by one like CSV import does
+func mergeDump(dump databaseDump, client string) (importReport, error) {
+	var report importReport
+	for i, book := range dump.Books {
+		row := importRow{Line: i + 1}
+		book, err := validateBook(book)
+		if err == nil {
+			book, err = createBook(book, client)
+		}
+		var fieldErr *FieldError
+		switch {
+		case err == nil:
+			row.Status, row.ID = "accepted", book.ID
+		case errors.As(err, &fieldErr):
+			row.Status, row.Field, row.Error = "rejected", fieldErr.Field, fieldErr.Err.Error()
+		case errors.Is(err, errBookExists):
+			row.Status, row.Error = "duplicate", err.Error()
+		default:
+			return report, err
+		}
+		report.add(row)
+	}
+	return report, nil
+}
+
+// replaceWithDump checks the whole dump first and replaces the books only if
+// every one of them is valid and unique. The ID sequence moves past both the
+// old and the dumped IDs, so no ID is handed out twice. Every book the
+// replacement adds, changes or removes gets a history entry by client
+func replaceWithDump(dump databaseDump, client string) (importReport, error) {
+	var report importReport
+	unlock, err := lockDB(true)
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+
+	books := make([]Book, 0, len(dump.Books))
+	seenIDs := make(map[string]int)
+	seenTitles := make(map[bookTitle]int)
+	last := dump.LastID
+	for i, book := range dump.Books {
+		row := importRow{Line: i + 1, ID: book.ID}
+		validated, err := validateBook(book)
+		id, idErr := strconv.Atoi(book.ID)
+		var fieldErr *FieldError
+		switch {
+		case errors.As(err, &fieldErr):
+			row.Status, row.Field, row.Error = "rejected", fieldErr.Field, fieldErr.Err.Error()
+		case idErr != nil:
+			row.Status, row.Field, row.Error = "rejected", "id", "ID должен быть числом"
+		case seenIDs[book.ID] > 0:
+			row.Status, row.Error = "duplicate", fmt.Sprintf("ID %s уже есть у книги %d", book.ID, seenIDs[book.ID])
+		case seenTitles[bookTitle{validated.Name, validated.Authors}] > 0:
+			row.Status, row.Error = "duplicate", fmt.Sprintf("книга уже есть под номером %d", seenTitles[bookTitle{validated.Name, validated.Authors}])
+		default:
+			row.Status = "accepted"
+			seenIDs[book.ID] = i + 1
+			seenTitles[bookTitle{validated.Name, validated.Authors}] = i + 1
+			books = append(books, validated)
+			last = max(last, id)
+		}
+		report.add(row)
+	}
+	if report.Rejected > 0 || report.Duplicates > 0 {
+		return report, errDumpRejected
+	}
+
+	if seq, ok := store.(sequenced); ok {
+		if err := seq.AdvanceID(last); err != nil {
+			return report, err
+		}
+	}
+	old, err := store.List()
+	if err != nil {
+		return report, err
+	}
+	if err := store.ReplaceAll(books); err != nil {
+		return report, err
+	}
+	recordReplacement(old, books, client)
+	return report, nil
+}
+
+// runDump implements the "dump [-o файл]" command
+func runDump(args []string) int {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	output := fs.String("o", "", "файл для записи (по умолчанию стандартный вывод)")
+	fs.Parse(args)
+
+	dump, err := dumpDatabase()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ошибка: %v\n", err)
+		return 2
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ошибка: %v\n", err)
+		return 2
+	}
+	data = append(data, '\n')
+
+	if *output == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Ошибка: %v\n", err)
+		return 2
+	}
+	fmt.Printf("Выгружено книг: %d, последний ID: %d\n", len(dump.Books), dump.LastID)
+	return 0
+}
+
+// runRestore implements the "restore [-mode merge|replace] файл.json" command
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	mode := fs.String("mode", restoreMerge, "merge - добавить книги с новыми ID, replace - заменить всю базу")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println("Использование: restore [-mode merge|replace] файл.json")
+		return 2
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Ошибка: %v\n", err)
+		return 2
+	}
+	var dump databaseDump
+	if err := json.Unmarshal(data, &dump); err != nil {
+		fmt.Printf("Ошибка чтения дампа: %v\n", err)
+		return 2
+	}
+
+	report, err := restoreDatabase(dump, *mode, "cli:restore")
+	if len(report.Rows) > 0 {
+		fmt.Print(formatImportReport(report, "книга"))
+	}
+	if err != nil {
+		fmt.Printf("Ошибка: %v\n", err)
+		if errors.Is(err, errDumpRejected) {
+			return 1
+		}
+		return 2
+	}
+	if report.Rejected > 0 || report.Duplicates > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// dumpTestBook is newTestBook with an ID
+func dumpTestBook(id, name string) Book {
+	book := newTestBook(name)
+	book.ID = id
+	return book
+}
+
+// TestRestoreMerge checks that a merged dump adds its books under new IDs
+// and skips the books that conflict with the database or fail validation
+func TestRestoreMerge(t *testing.T) {
+	useMemoryDatabase(t, dumpTestBook("1", "Первая книга"), dumpTestBook("2", "Вторая книга"))
+
+	invalid := dumpTestBook("7", "Книга из будущего")
+	invalid.Year = "3000"
+	dump := databaseDump{Format: currentFormat, LastID: 10, Books: []Book{
+		dumpTestBook("2", "Третья книга"),
+		dumpTestBook("5", "Первая книга"),
+		invalid,
+	}}
+	report, err := restoreDatabase(dump, restoreMerge, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := []string{}
+	for _, row := range report.Rows {
+		statuses = append(statuses, row.Status)
+	}
+	if want := []string{"accepted", "duplicate", "rejected"}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("отчет %+v, ожидались %v", report.Rows, want)
+	}
+
+	books, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bookIDs(books); !reflect.DeepEqual(got, []string{"1", "2", "3"}) {
+		t.Errorf("после слияния ID %v, ожидались 1, 2, 3", got)
+	}
+	if books[1].Name != "Вторая книга" || books[2].Name != "Третья книга" {
+		t.Errorf("книга с тем же ID заменила существующую: %+v", books)
+	}
+}
+
+// TestRestoreReplace checks that replace keeps the dumped IDs, refuses the
+// whole dump if one book is bad or repeats another, and moves the ID
+// sequence past the dumped IDs
+func TestRestoreReplace(t *testing.T) {
+	useMemoryDatabase(t, dumpTestBook("1", "Первая книга"), dumpTestBook("2", "Вторая книга"))
+	before, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := dumpTestBook("3", "Книга из будущего")
+	invalid.Year = "3000"
+	for name, books := range map[string][]Book{
+		"invalid":   {dumpTestBook("2", "Третья книга"), invalid},
+		"same id":   {dumpTestBook("2", "Третья книга"), dumpTestBook("2", "Четвертая книга")},
+		"same book": {dumpTestBook("2", "Третья книга"), dumpTestBook("4", "Третья книга")},
+	} {
+		dump := databaseDump{Format: currentFormat, LastID: 2, Books: books}
+		if _, err := restoreDatabase(dump, restoreReplace, "test"); !errors.Is(err, errDumpRejected) {
+			t.Errorf("%s: %v, ожидалось %v", name, err, errDumpRejected)
+		}
+		if after, _ := store.List(); !reflect.DeepEqual(after, before) {
+			t.Errorf("%s: отклоненный дамп изменил базу: %+v", name, after)
+		}
+	}
+
+	dump := databaseDump{Format: currentFormat, LastID: 3, Books: []Book{
+		dumpTestBook("2", "Третья книга"),
+		dumpTestBook("5", "Первая книга"),
+	}}
+	report, err := restoreDatabase(dump, restoreReplace, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Accepted != 2 {
+		t.Errorf("отчет %+v", report)
+	}
+	books, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(books, dump.Books) {
+		t.Errorf("после замены %+v, ожидалось %+v", books, dump.Books)
+	}
+	if id, err := store.NextID(); err != nil || id != 6 {
+		t.Errorf("следующий ID %d, %v, ожидался 6", id, err)
+	}
+
+	if _, err := restoreDatabase(dump, "append", "test"); err == nil {
+		t.Error("неизвестный режим восстановления принят")
+	}
+}
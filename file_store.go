@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// fileStore keeps books in a pipe-delimited text file, one book per line.
+// Every modification is written to a journal before it touches the file
+type fileStore struct {
+	path     string
+	tempPath string
+	wal      *journal
+	lock     *fileLock
+	seq      *idSequence
+
+	indexMu sync.Mutex
+	index   *bookIndex
+}
+
+func newFileStore(path, tempPath string) *fileStore {
+	return &fileStore{
+		path:     path,
+		tempPath: tempPath,
+		wal:      &journal{path: path + ".wal"},
+		lock:     &fileLock{path: path + ".lock"},
+		seq:      &idSequence{path: path + ".seq"},
+	}
+}
+
+// Lock guards the file against other processes that open the same database
+func (s *fileStore) Lock(exclusive bool) (func(), error) {
+	return s.lock.Lock(exclusive)
+}
+
+// splitFields splits a stored line into its columns
+func splitFields(line string, version int) []string {
+	if version == formatV1 {
+		return strings.Split(strings.TrimSpace(line), "|")
+	}
+	return splitEscaped(line)
+}
+
+func lineToDict(line string, version int) (map[string]string, error) {
+	parts := splitFields(line, version)
+
+	count := fieldCount(version)
+	if len(parts) < count {
+		return nil, fmt.Errorf("недостаточно частей в строке (ожидается %d, получено %d)", count, len(parts))
+	}
+
+	dict := map[string]string{
+		"id":         parts[0],
+		"name":       parts[1],
+		"year":       parts[2],
+		"authors":    parts[3],
+		"genres":     parts[4],
+		"width":      parts[5],
+		"height":     parts[6],
+		"book_type":  parts[7],
+		"source":     parts[8],
+		"date_added": parts[9],
+		"date_read":  parts[10],
+	}
+	if version < formatV3 {
+		dict["score"], dict["review"] = splitRating(parts[11])
+	} else {
+		dict["score"], dict["review"] = parts[11], parts[12]
+	}
+	return dict, nil
+}
+
+func lineToBook(line string, version int) (Book, error) {
+	bookMap, err := lineToDict(line, version)
+	if err != nil {
+		return Book{}, err
+	}
+
+	return Book{
+		ID:      bookMap["id"],
+		Name:    bookMap["name"],
+		Year:    bookMap["year"],
+		Authors: bookMap["authors"],
+		Genres:  bookMap["genres"],
+		Width:   bookMap["width"],
+		Height:  bookMap["height"],
+		Cover:   bookMap["book_type"],
+		Source:  bookMap["source"],
+		Added:   bookMap["date_added"],
+		Read:    bookMap["date_read"],
+		Score:   bookMap["score"],
+		Review:  bookMap["review"],
+	}, nil
+}
+
+// bookToLine encodes a book in the current format
+func bookToLine(book Book) string {
+	fields := []string{
+		book.ID,
+		book.Name,
+		book.Year,
+		book.Authors,
+		book.Genres,
+		book.Width,
+		book.Height,
+		book.Cover,
+		book.Source,
+		book.Added,
+		book.Read,
+		book.Score,
+		book.Review,
+	}
+	for i, field := range fields {
+		fields[i] = escapeField(field)
+	}
+	return strings.Join(fields, "|") + "\n"
+}
+
+// formatVersion reads the header of the books file. A missing or empty
+// file counts as the current format since the next write will create it
+func (s *fileStore) formatVersion() (int, error) {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return currentFormat, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ошибка открытия файла: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return currentFormat, scanner.Err()
+	}
+	version, ok := parseFormatHeader(scanner.Text())
+	if !ok {
+		return formatV1, nil
+	}
+	return version, checkFormatVersion(version)
+}
+
+// upgradeFormat rewrites a file in an older format into the current one
+func (s *fileStore) upgradeFormat() error {
+	version, err := s.formatVersion()
+	if err != nil || version == currentFormat {
+		return err
+	}
+	if err := s.rewrite(func(book Book) (Book, bool) { return book, true }); err != nil {
+		return fmt.Errorf("ошибка обновления формата файла: %v", err)
+	}
+	log.Printf("Формат файла %s обновлен с версии %d до %d", s.path, version, currentFormat)
+	return nil
+}
+
+func (s *fileStore) Scan(fn func(Book) bool) error {
+	return s.scanLines(func(book Book, _ int64) bool { return fn(book) })
+}
+
+// scanLines is Scan that also passes the offset of the book's line
+func (s *fileStore) scanLines(fn func(book Book, offset int64) bool) error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil // Файла нет - книг нет
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка открытия файла: %v", err)
+	}
+	defer file.Close()
+
+	version := formatV1
+	first := true
+	var pos, offset int64
+	scanner := bufio.NewScanner(file)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			offset = pos
+		}
+		pos += int64(advance)
+		return advance, token, err
+	})
+	for scanner.Scan() {
+		line := scanner.Text()
+		if first {
+			first = false
+			if v, ok := parseFormatHeader(line); ok {
+				if err := checkFormatVersion(v); err != nil {
+					return err
+				}
+				version = v
+				continue
+			}
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		book, err := lineToBook(line, version)
+		if err != nil {
+			return fmt.Errorf("ошибка парсинга строки: %v", err)
+		}
+		if !fn(book, offset) {
+			return nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("ошибка чтения файла: %v", err)
+	}
+	return nil
+}
+
+func (s *fileStore) List() ([]Book, error) {
+	var books []Book
+	err := s.Scan(func(book Book) bool {
+		books = append(books, book)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+func (s *fileStore) Get(id string) (Book, error) {
+	index, err := s.currentIndex()
+	if err != nil {
+		return Book{}, err
+	}
+	books, err := s.readBooks(index, []string{id})
+	if err != nil {
+		return Book{}, err
+	}
+	if len(books) == 0 {
+		return Book{}, errBookNotFound
+	}
+	return books[0], nil
+}
+
+func (s *fileStore) Insert(book Book) error {
+	// Строки нового формата нельзя дописывать в файл старого
+	if err := s.upgradeFormat(); err != nil {
+		return err
+	}
+	size, err := fileSize(s.path)
+	if err != nil {
+		return err
+	}
+	_, err = s.logged(walRecord{Op: walInsert, Book: &book, Size: size})
+	return err
+}
+
+func (s *fileStore) Replace(book Book) error {
+	_, err := s.logged(walRecord{Op: walReplace, Book: &book})
+	return err
+}
+
+func (s *fileStore) Remove(ids []string) ([]Book, error) {
+	return s.logged(walRecord{Op: walRemove, IDs: ids})
+}
+
+func (s *fileStore) ReplaceAll(books []Book) error {
+	_, err := s.logged(walRecord{Op: walReplaceAll, Books: books})
+	return err
+}
+
+// logged journals rec, applies it and checkpoints the journal. If applying
+// fails the file is left as it was before the operation
+func (s *fileStore) logged(rec walRecord) ([]Book, error) {
+	existed := true
+	if rec.Op == walInsert {
+		if _, err := os.Stat(s.path); os.IsNotExist(err) {
+			existed = false
+		}
+	}
+	if err := s.wal.begin(rec); err != nil {
+		return nil, err
+	}
+
+	books, err := s.apply(rec)
+	if err != nil && rec.Op == walInsert {
+		s.undoInsert(rec.Size, existed)
+	}
+
+	if cerr := s.wal.checkpoint(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return books, err
+}
+
+// undoInsert drops what a failed insert may have written: the file is cut
+// back to size, or removed if the insert was about to create it
+func (s *fileStore) undoInsert(size int64, existed bool) {
+	if existed {
+		os.Truncate(s.path, size)
+	} else {
+		os.Remove(s.path)
+	}
+}
+
+// apply performs the operation described by rec. It is used both for new
+// operations and for replaying the journal after a crash
+func (s *fileStore) apply(rec walRecord) ([]Book, error) {
+	switch rec.Op {
+	case walInsert:
+		if err := s.appendLine(rec.Size, *rec.Book); err != nil {
+			return nil, err
+		}
+		return []Book{*rec.Book}, nil
+
+	case walReplace:
+		found := false
+		err := s.rewrite(func(existing Book) (Book, bool) {
+			if existing.ID == rec.Book.ID {
+				found = true
+				return *rec.Book, true
+			}
+			return existing, true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, errBookNotFound
+		}
+		return []Book{*rec.Book}, nil
+
+	case walRemove:
+		var removed []Book
+		err := s.rewrite(func(existing Book) (Book, bool) {
+			if contains(rec.IDs, existing.ID) {
+				removed = append(removed, existing)
+				return existing, false
+			}
+			return existing, true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(removed) == 0 {
+			return nil, errBookNotFound
+		}
+		return removed, nil
+
+	case walReplaceAll:
+		err := s.writeFile(func(write func(Book) bool) error {
+			for _, book := range rec.Books {
+				if !write(book) {
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return rec.Books, nil
+	}
+
+	return nil, fmt.Errorf("неизвестная операция журнала: %s", rec.Op)
+}
+
+// appendLine writes book at offset size, dropping anything a torn append left after it
+func (s *fileStore) appendLine(size int64, book Book) error {
+	before, err := statFile(s.path)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия файла: %v", err)
+	}
+	defer file.Close()
+
+	if err := file.Truncate(size); err != nil {
+		return fmt.Errorf("ошибка записи в файл: %v", err)
+	}
+	line := bookToLine(book)
+	offset := size
+	if size == 0 {
+		line = formatHeader(currentFormat) + line
+		offset = int64(len(formatHeader(currentFormat)))
+	}
+	if _, err := file.WriteAt([]byte(line), size); err != nil {
+		s.setIndex(nil)
+		return fmt.Errorf("ошибка записи в файл: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		s.setIndex(nil)
+		return fmt.Errorf("ошибка синхронизации файла: %v", err)
+	}
+	if before != nil && before.Size() != size {
+		s.setIndex(nil) // обрезан хвост недописанной строки, индекс строится заново
+		return nil
+	}
+	s.indexAppended(before, book, offset)
+	return nil
+}
+
+// rewrite copies every book through fn into a new books file.
+// fn returns the book to write and whether to keep it
+func (s *fileStore) rewrite(fn func(Book) (Book, bool)) error {
+	return s.writeFile(func(write func(Book) bool) error {
+		return s.Scan(func(book Book) bool {
+			book, keep := fn(book)
+			if !keep {
+				return true
+			}
+			return write(book)
+		})
+	})
+}
+
+// writeFile writes the books that fill passes to write into the temporary
+// file and renames it over the original, so the books file is always
+// either old or new
+func (s *fileStore) writeFile(fill func(write func(Book) bool) error) error {
+	tempFile, err := os.Create(s.tempPath)
+	if err != nil {
+		return fmt.Errorf("ошибка создания временного файла: %v", err)
+	}
+	defer tempFile.Close()
+
+	// Индекс нового файла строится по ходу записи
+	index := newBookIndex(currentFormat)
+	offset := int64(len(formatHeader(currentFormat)))
+
+	_, writeErr := tempFile.WriteString(formatHeader(currentFormat))
+	err = fill(func(book Book) bool {
+		if writeErr != nil {
+			return false
+		}
+		line := bookToLine(book)
+		if _, writeErr = tempFile.WriteString(line); writeErr != nil {
+			return false
+		}
+		index.add(book, offset)
+		offset += int64(len(line))
+		return true
+	})
+	if err == nil && writeErr != nil {
+		err = fmt.Errorf("ошибка записи во временный файл: %v", writeErr)
+	}
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if err == nil {
+		err = tempFile.Close()
+	}
+	if err != nil {
+		os.Remove(s.tempPath)
+		return err
+	}
+
+	if err := os.Rename(s.tempPath, s.path); err != nil {
+		s.setIndex(nil)
+		return fmt.Errorf("ошибка переименования временного файла: %v", err)
+	}
+	s.setIndex(index)
+	return nil
+}
+
+// Recover brings the books file to a consistent state after a crash,
+// upgrades it to the current format and creates the ID sequence for
+// databases that don't have one yet
+func (s *fileStore) Recover() error {
+	if err := s.replayJournal(); err != nil {
+		return err
+	}
+	if err := s.upgradeFormat(); err != nil {
+		return err
+	}
+	return s.migrateIDs()
+}
+
+// replayJournal replays every intact journal record and discards torn ones
+func (s *fileStore) replayJournal() error {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		// Старые версии удаляли файл перед переименованием временного
+		if err := os.Rename(s.tempPath, s.path); err == nil {
+			log.Printf("Восстановление: %s восстановлен из %s", s.path, s.tempPath)
+		}
+	}
+	if err := os.Remove(s.tempPath); err == nil {
+		log.Printf("Восстановление: удален незавершенный временный файл %s", s.tempPath)
+	}
+
+	records, torn, err := s.wal.records()
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if _, err := s.apply(rec); err != nil && !errors.Is(err, errBookNotFound) {
+			return fmt.Errorf("ошибка повтора операции %s из журнала: %v", rec.Op, err)
+		}
+		log.Printf("Восстановление: повторена операция %s из журнала", rec.Op)
+	}
+	if torn > 0 {
+		log.Printf("Восстановление: отброшено поврежденных записей журнала: %d", torn)
+	}
+	if len(records) > 0 || torn > 0 {
+		log.Printf("Восстановление завершено: повторено %d, отброшено %d", len(records), torn)
+	}
+	return s.wal.checkpoint()
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ошибка открытия файла: %v", err)
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+// Lock is a no-op where flock is not available: only the in-process lock applies
+func (l *fileLock) Lock(exclusive bool) (func(), error) {
+	return func() {}, nil
+}
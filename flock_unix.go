@@ -0,0 +1,58 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Lock takes a flock on the sidecar file: shared for readers, exclusive for
+// writers. The exclusive holder writes its PID into the file so that a
+// process that times out can say who holds the database
+func (l *fileLock) Lock(exclusive bool) (func(), error) {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия файла блокировки: %v", err)
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			file.Close()
+			return nil, fmt.Errorf("ошибка блокировки базы данных: %v", err)
+		}
+		if time.Now().After(deadline) {
+			pid := readLockPID(file)
+			file.Close()
+			return nil, &LockedError{PID: pid}
+		}
+		time.Sleep(lockRetryInterval)
+	}
+
+	if exclusive {
+		file.Truncate(0)
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	return func() {
+		if exclusive {
+			file.Truncate(0)
+		}
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
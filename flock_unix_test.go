@@ -0,0 +1,61 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestFileLockConflict opens two locks on one sidecar file, as two processes
+// would, and checks that the second one times out with the PID of the holder
+// of an exclusive lock and gets the lock once it is released
+func TestFileLockConflict(t *testing.T) {
+	saved := lockTimeout
+	lockTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { lockTimeout = saved })
+
+	path := filepath.Join(t.TempDir(), "books.lock")
+	holder, other := &fileLock{path: path}, &fileLock{path: path}
+
+	unlock, err := holder.Lock(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, exclusive := range []bool{true, false} {
+		start := time.Now()
+		_, err := other.Lock(exclusive)
+		var locked *LockedError
+		if !errors.As(err, &locked) {
+			t.Fatalf("вторая блокировка (exclusive=%v): %v, ожидалась LockedError", exclusive, err)
+		}
+		if locked.PID != os.Getpid() {
+			t.Errorf("в ошибке PID %d, ожидался %d", locked.PID, os.Getpid())
+		}
+		if waited := time.Since(start); waited < lockTimeout {
+			t.Errorf("ошибка через %v, раньше lockTimeout %v", waited, lockTimeout)
+		}
+	}
+	unlock()
+
+	unlockOther, err := other.Lock(true)
+	if err != nil {
+		t.Fatalf("блокировка после освобождения: %v", err)
+	}
+	unlockOther()
+
+	// Разделяемые блокировки не мешают друг другу
+	unlockShared, err := holder.Lock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlockShared()
+	unlockOtherShared, err := other.Lock(false)
+	if err != nil {
+		t.Fatalf("вторая разделяемая блокировка: %v", err)
+	}
+	unlockOtherShared()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Версии формата файла книг
+const (
+	// formatV1 is the original format: no header, fields split on "|" as is
+	formatV1 = 1
+	// formatV2 starts with a header line and escapes "\", "|", "\n" and "\r"
+	// inside fields, so any string survives a write and read
+	formatV2 = 2
+	// formatV3 stores the rating as two columns, a numeric score and a review,
+	// instead of one "X/10 - comment" string
+	formatV3 = 3
+
+	currentFormat = formatV3
+)
+
+const formatHeaderPrefix = "#crud_in_txt format "
+
+func formatHeader(version int) string {
+	return formatHeaderPrefix + strconv.Itoa(version) + "\n"
+}
+
+// parseFormatHeader returns the version from a header line, or false if
+// the line is not a header (the file is then in formatV1)
+func parseFormatHeader(line string) (int, bool) {
+	if !strings.HasPrefix(line, formatHeaderPrefix) {
+		return 0, false
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, formatHeaderPrefix)))
+	if err != nil {
+		return 0, false
+	}
+	return version, true
+}
+
+func checkFormatVersion(version int) error {
+	if version < formatV1 || version > currentFormat {
+		return fmt.Errorf("неподдерживаемая версия формата файла: %d", version)
+	}
+	return nil
+}
+
+// fieldCount is the number of columns of a line in the given version
+func fieldCount(version int) int {
+	if version < formatV3 {
+		return 12
+	}
+	return 13
+}
+
+var legacyRating = regexp.MustCompile(`^\s*([1-9]|10)\s*/\s*10\s*(?:-\s*(.*))?$`)
+
+// splitRating turns a rating of formatV1 and formatV2 ("8/10 - отличная книга")
+// into a score and a review. Text that doesn't follow the pattern is kept as
+// the review without a score
+func splitRating(rating string) (score, review string) {
+	if m := legacyRating.FindStringSubmatch(rating); m != nil {
+		return m[1], strings.TrimSpace(m[2])
+	}
+	return "", strings.TrimSpace(rating)
+}
+
+var fieldEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", `\n`, "\r", `\r`)
+
+func escapeField(value string) string {
+	return fieldEscaper.Replace(value)
+}
+
+// splitEscaped splits a formatV2 line on unescaped "|" and unescapes every field
+func splitEscaped(line string) []string {
+	var fields []string
+	var field strings.Builder
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			switch r {
+			case 'n':
+				field.WriteRune('\n')
+			case 'r':
+				field.WriteRune('\r')
+			default:
+				field.WriteRune(r)
+			}
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '|':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(fields, field.String())
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestEscapedFieldsRoundTrip checks that values with the characters the
+// format escapes are read back exactly as they were written
+func TestEscapedFieldsRoundTrip(t *testing.T) {
+	values := []string{
+		`обратная черта в конце\`,
+		`\`,
+		`\\`,
+		"a|b|c",
+		`\|`,
+		"|",
+		"первая строка\nвторая строка",
+		"возврат\r\nкаретки",
+		`буквально \n и \r`,
+		"",
+	}
+	for _, value := range values {
+		book := newTestBook("Книга")
+		book.ID = "1"
+		book.Name = value
+		book.Review = value
+
+		line := bookToLine(book)
+		if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, "\n") {
+			t.Errorf("%q: строка %q занимает не одну строку файла", value, line)
+			continue
+		}
+		got, err := lineToBook(strings.TrimSuffix(line, "\n"), currentFormat)
+		if err != nil {
+			t.Errorf("%q: %v", value, err)
+			continue
+		}
+		if got != book {
+			t.Errorf("%q: прочитано %+v", value, got)
+		}
+	}
+}
+
+// TestSplitEscaped checks that only an unescaped "|" separates fields
+func TestSplitEscaped(t *testing.T) {
+	cases := []struct {
+		line string
+		want []string
+	}{
+		{`a|b`, []string{"a", "b"}},
+		{`a\|b|c`, []string{"a|b", "c"}},
+		{`a\\|b`, []string{`a\`, "b"}},
+		{`a\n\r|`, []string{"a\n\r", ""}},
+		{`\\\|`, []string{`\|`}},
+	}
+	for _, c := range cases {
+		got := splitEscaped(c.line)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("splitEscaped(%q) = %q, ожидалось %q", c.line, got, c.want)
+		}
+	}
+}
+
+// TestUpgradeLegacyFormat loads files without a header (version 1) and with
+// the version 2 header and checks that Recover rewrites them in the current
+// format with the rating split into score and review
+func TestUpgradeLegacyFormat(t *testing.T) {
+	silenceLog(t)
+	cases := []struct {
+		name, content string
+		want          []Book
+	}{
+		{
+			// В версии 1 поля не экранируются: "\" хранится как есть
+			name: "v1",
+			content: `1|Записки\Дневник|2000|Тестовый Автор|Роман|100|200|мягкий|покупка|01-01-2020||8/10 - отличная книга` + "\n" +
+				`2|Вторая книга|2000|Тестовый Автор|Роман|100|200|мягкий|покупка|01-01-2020|02-01-2020|понравилась` + "\n",
+			want: []Book{
+				{ID: "1", Name: `Записки\Дневник`, Score: "8", Review: "отличная книга"},
+				{ID: "2", Name: "Вторая книга", Read: "02-01-2020", Review: "понравилась"},
+			},
+		},
+		{
+			name: "v2",
+			content: formatHeader(formatV2) +
+				`1|Книга \| с чертой|2000|Тестовый Автор|Роман|100|200|мягкий|покупка|01-01-2020||10/10` + "\n",
+			want: []Book{
+				{ID: "1", Name: "Книга | с чертой", Score: "10"},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "books")
+			if err := os.WriteFile(path, []byte(c.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			s := newFileStore(path, filepath.Join(dir, "books.tmp"))
+			if err := s.Recover(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(data), formatHeader(currentFormat)) {
+				t.Errorf("файл не обновлен до версии %d:\n%s", currentFormat, data)
+			}
+
+			books, err := s.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(books) != len(c.want) {
+				t.Fatalf("прочитано %d книг, ожидалось %d", len(books), len(c.want))
+			}
+			for i, want := range c.want {
+				got := books[i]
+				if got.ID != want.ID || got.Name != want.Name || got.Read != want.Read ||
+					got.Score != want.Score || got.Review != want.Review {
+					t.Errorf("книга %d: %+v, ожидалось %+v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
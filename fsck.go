@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fsckIssue is one problem found in a line of the books file
+type fsckIssue struct {
+	Line    int
+	Problem string
+}
+
+// fsckReport is the result of checking the books file
+type fsckReport struct {
+	Lines       int
+	Issues      []fsckIssue
+	Quarantined int
+}
+
+// runFsck implements the "fsck [--repair]" command and returns the exit code
+func runFsck(args []string) int {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "перенести некорректные строки в карантинный файл")
+	fs.Parse(args)
+
+	fileStore, ok := store.(*fileStore)
+	if !ok {
+		fmt.Println("fsck поддерживается только для файлового хранилища")
+		return 2
+	}
+
+	unlock, err := lockDB(*repair)
+	if err != nil {
+		fmt.Printf("Ошибка: %v\n", err)
+		return 2
+	}
+	defer unlock()
+
+	report, err := fileStore.Fsck(*repair)
+	if err != nil {
+		fmt.Printf("Ошибка: %v\n", err)
+		return 2
+	}
+
+	for _, issue := range report.Issues {
+		fmt.Printf("строка %d: %s\n", issue.Line, issue.Problem)
+	}
+	fmt.Printf("Проверено строк: %d, проблем: %d\n", report.Lines, len(report.Issues))
+	if *repair && report.Quarantined > 0 {
+		fmt.Printf("Перенесено в %s: %d\n", fileStore.quarantinePath(), report.Quarantined)
+	}
+
+	if len(report.Issues) > 0 && !*repair {
+		return 1
+	}
+	return 0
+}
+
+func (s *fileStore) quarantinePath() string {
+	return s.path + ".quarantine"
+}
+
+// Fsck checks every line of the books file: the field count, every Validate*
+// rule, duplicate IDs and duplicate name+authors pairs as isUniqueBook sees
+// them. With repair, the offending lines are moved to the quarantine file
+// and the rest of the file is kept as is
+func (s *fileStore) Fsck(repair bool) (fsckReport, error) {
+	var report fsckReport
+
+	if repair {
+		if err := s.replayJournal(); err != nil {
+			return report, err
+		}
+	} else if records, torn, err := s.wal.records(); err == nil && len(records)+torn > 0 {
+		report.Issues = append(report.Issues, fsckIssue{Problem: fmt.Sprintf("журнал содержит незавершенных операций: %d", len(records)+torn)})
+	}
+
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return report, nil
+	}
+	if err != nil {
+		return report, fmt.Errorf("ошибка открытия файла: %v", err)
+	}
+	defer file.Close()
+
+	seenIDs := make(map[string]int)
+	seenBooks := make(map[string]int)
+	var good []string
+	var bad []string
+
+	// Длина строки не ограничена, чтобы слишком длинная строка попала в
+	// отчет и в карантин, а не прервала проверку
+	version := formatV1
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return report, fmt.Errorf("ошибка чтения файла: %v", err)
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		report.Lines++
+		if report.Lines == 1 {
+			if v, ok := parseFormatHeader(line); ok {
+				if err := checkFormatVersion(v); err != nil {
+					return report, err
+				}
+				version = v
+				good = append(good, strings.TrimSuffix(formatHeader(v), "\n"))
+				continue
+			}
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		problems := checkLine(line, version, report.Lines, seenIDs, seenBooks)
+		for _, problem := range problems {
+			report.Issues = append(report.Issues, fsckIssue{Line: report.Lines, Problem: problem})
+		}
+		if len(problems) == 0 {
+			good = append(good, line)
+		} else {
+			bad = append(bad, fmt.Sprintf("# строка %d: %s\n%s", report.Lines, strings.Join(problems, "; "), line))
+		}
+	}
+	file.Close()
+
+	if !repair || len(bad) == 0 {
+		return report, nil
+	}
+
+	quarantine, err := os.OpenFile(s.quarantinePath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return report, fmt.Errorf("ошибка открытия карантинного файла: %v", err)
+	}
+	defer quarantine.Close()
+	for _, entry := range bad {
+		if _, err := quarantine.WriteString(entry + "\n"); err != nil {
+			return report, fmt.Errorf("ошибка записи в карантинный файл: %v", err)
+		}
+	}
+	if err := quarantine.Sync(); err != nil {
+		return report, fmt.Errorf("ошибка записи в карантинный файл: %v", err)
+	}
+
+	if err := s.writeLines(good); err != nil {
+		return report, err
+	}
+	report.Quarantined = len(bad)
+	return report, nil
+}
+
+// checkLine returns every problem of a single line. seenIDs and seenBooks
+// remember the first line of each ID and name+authors pair
+func checkLine(line string, version, lineNo int, seenIDs, seenBooks map[string]int) []string {
+	parts := splitFields(line, version)
+	if count := fieldCount(version); len(parts) != count {
+		return []string{fmt.Sprintf("неверное число полей: %d вместо %d", len(parts), count)}
+	}
+
+	book, err := lineToBook(line, version)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var problems []string
+	if _, err := strconv.Atoi(book.ID); err != nil {
+		problems = append(problems, fmt.Sprintf("ID %q не является числом", book.ID))
+	} else if first, ok := seenIDs[book.ID]; ok {
+		problems = append(problems, fmt.Sprintf("повторяющийся ID %s (впервые в строке %d)", book.ID, first))
+	} else {
+		seenIDs[book.ID] = lineNo
+	}
+
+	// Проверяем каждое поле отдельно, чтобы сообщить обо всех ошибках сразу
+	validated := Book{Year: book.Year, Added: book.Added}
+	for _, field := range editableFields {
+		if err := validated.setField(field, book.getField(field)); err != nil {
+			problems = append(problems, fmt.Sprintf("поле %s: %v", field, err))
+		}
+	}
+
+	key := book.Name + "|" + book.Authors
+	if first, ok := seenBooks[key]; ok {
+		problems = append(problems, fmt.Sprintf("книга %q (%s) уже есть в строке %d", book.Name, book.Authors, first))
+	} else {
+		seenBooks[key] = lineNo
+	}
+
+	return problems
+}
+
+// writeLines replaces the books file with the given raw lines
+func (s *fileStore) writeLines(lines []string) error {
+	tempFile, err := os.Create(s.tempPath)
+	if err != nil {
+		return fmt.Errorf("ошибка создания временного файла: %v", err)
+	}
+	defer tempFile.Close()
+
+	for _, line := range lines {
+		if _, err := tempFile.WriteString(line + "\n"); err != nil {
+			os.Remove(s.tempPath)
+			return fmt.Errorf("ошибка записи во временный файл: %v", err)
+		}
+	}
+	if err := tempFile.Sync(); err != nil {
+		os.Remove(s.tempPath)
+		return fmt.Errorf("ошибка записи во временный файл: %v", err)
+	}
+	tempFile.Close()
+
+	if err := os.Rename(s.tempPath, s.path); err != nil {
+		return fmt.Errorf("ошибка переименования временного файла: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestFsckRepair checks a file with one good line and one line for each kind
+// of problem, then repairs it and checks both the books file and the
+// quarantine file
+func TestFsckRepair(t *testing.T) {
+	s, path := newTempFileStore(t)
+
+	good := newTestBook("Хорошая книга")
+	good.ID = "1"
+	badYear := newTestBook("Книга из будущего")
+	badYear.ID, badYear.Year = "2", "3000"
+	sameID := newTestBook("Книга с чужим ID")
+	sameID.ID = "1"
+	sameTitle := good
+	sameTitle.ID = "4"
+	lines := []string{
+		strings.TrimSuffix(formatHeader(currentFormat), "\n"),
+		strings.TrimSuffix(bookToLine(good), "\n"),
+		strings.TrimSuffix(bookToLine(badYear), "\n"),
+		"3|Обрезанная строка|2000",
+		strings.TrimSuffix(bookToLine(sameID), "\n"),
+		strings.TrimSuffix(bookToLine(sameTitle), "\n"),
+	}
+	content := strings.Join(lines, "\n") + "\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problemLines := []int{}
+	for _, issue := range report.Issues {
+		if len(problemLines) == 0 || problemLines[len(problemLines)-1] != issue.Line {
+			problemLines = append(problemLines, issue.Line)
+		}
+	}
+	if want := []int{3, 4, 5, 6}; !reflect.DeepEqual(problemLines, want) {
+		t.Errorf("проблемы в строках %v, ожидались %v: %+v", problemLines, want, report.Issues)
+	}
+	if data, _ := os.ReadFile(path); string(data) != content {
+		t.Errorf("проверка без --repair изменила файл:\n%s", data)
+	}
+
+	report, err = s.Fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Quarantined != 4 {
+		t.Errorf("в карантин перенесено строк: %d, ожидалось 4", report.Quarantined)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := lines[0] + "\n" + lines[1] + "\n"; string(data) != want {
+		t.Errorf("после исправления файл:\n%s\nожидался:\n%s", data, want)
+	}
+
+	quarantine, err := os.ReadFile(s.quarantinePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range lines[2:] {
+		if !strings.Contains(string(quarantine), line+"\n") {
+			t.Errorf("строки %d нет в карантине:\n%s", i+3, quarantine)
+		}
+	}
+	if !strings.Contains(string(quarantine), "# строка 4: неверное число полей") {
+		t.Errorf("в карантине нет причины для обрезанной строки:\n%s", quarantine)
+	}
+
+	if report, err := s.Fsck(false); err != nil || len(report.Issues) != 0 {
+		t.Errorf("после исправления: %+v, %v", report.Issues, err)
+	}
+}
+
+// TestFsckLongLine checks that a line longer than a bufio.Scanner token is
+// reported and quarantined instead of stopping the check
+func TestFsckLongLine(t *testing.T) {
+	s, path := newTempFileStore(t)
+	good := newTestBook("Хорошая книга")
+	good.ID = "1"
+	long := newTestBook("Книга с длинным отзывом")
+	long.ID, long.Review = "2", strings.Repeat("очень длинный отзыв ", 10000)
+	content := formatHeader(currentFormat) + bookToLine(long) + bookToLine(good)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.Fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Line != 2 || report.Quarantined != 1 {
+		t.Errorf("отчет %+v", report)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := formatHeader(currentFormat) + bookToLine(good); string(data) != want {
+		t.Errorf("после исправления файл:\n%.200s", data)
+	}
+	quarantine, err := os.ReadFile(s.quarantinePath())
+	if err != nil || !strings.Contains(string(quarantine), strings.TrimSuffix(bookToLine(long), "\n")) {
+		t.Errorf("длинной строки нет в карантине: %v", err)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Действия, записываемые в историю
+const (
+	historyCreate  = "create"
+	historyUpdate  = "update"
+	historyDelete  = "delete"
+	historyRestore = "restore"
+	historyRevert  = "revert"
+)
+
+// historyEntry is one version of a book: the change that produced it, with
+// the book before and after (nil before a create and after a delete)
+type historyEntry struct {
+	BookID  string    `json:"book_id"`
+	Version int       `json:"version"`
+	Action  string    `json:"action"`
+	At      time.Time `json:"at"`
+	By      string    `json:"by"`
+	Before  *Book     `json:"before,omitempty"`
+	After   *Book     `json:"after,omitempty"`
+}
+
+// fieldChange is one field that differs between two versions of a book
+type fieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// changeLog is an append-only file of history entries, one JSON per line.
+// It is written under the exclusive database lock together with the change
+type changeLog struct {
+	path string
+
+	// versions caches the latest version of every book so a write doesn't
+	// reread the file. It describes the file at path of length size and is
+	// rebuilt when the file is changed by another process
+	mu         sync.Mutex
+	versions   map[string]int
+	cachedPath string
+	size       int64
+}
+
+var history = &changeLog{path: FILENAME + ".history"}
+
+var errVersionNotFound = errors.New("версия не найдена")
+
+// entries returns the history of one book, oldest version first
+func (h *changeLog) entries(bookID string) ([]historyEntry, error) {
+	var entries []historyEntry
+	err := h.scan(func(entry historyEntry) {
+		if entry.BookID == bookID {
+			entries = append(entries, entry)
+		}
+	})
+	return entries, err
+}
+
+// scan calls fn for every entry of the file in order
+func (h *changeLog) scan(fn func(historyEntry)) error {
+	file, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка открытия истории: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("ошибка чтения истории: %v", err)
+		}
+		fn(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("ошибка чтения истории: %v", err)
+	}
+	return nil
+}
+
+func (h *changeLog) fileSize() (int64, error) {
+	info, err := os.Stat(h.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ошибка открытия истории: %v", err)
+	}
+	return info.Size(), nil
+}
+
+// loadVersions reads the file into the version cache unless the cache
+// already describes it. The caller holds h.mu
+func (h *changeLog) loadVersions() error {
+	size, err := h.fileSize()
+	if err != nil {
+		return err
+	}
+	if h.versions != nil && h.cachedPath == h.path && h.size == size {
+		return nil
+	}
+	versions := make(map[string]int)
+	err = h.scan(func(entry historyEntry) {
+		versions[entry.BookID] = max(versions[entry.BookID], entry.Version)
+	})
+	if err != nil {
+		return err
+	}
+	h.versions, h.cachedPath, h.size = versions, h.path, size
+	return nil
+}
+
+// add appends each entry as the next version of its book
+func (h *changeLog) add(entries ...historyEntry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.loadVersions(); err != nil {
+		return err
+	}
+	versions := make(map[string]int)
+	for i := range entries {
+		id := entries[i].BookID
+		if _, ok := versions[id]; !ok {
+			versions[id] = h.versions[id]
+		}
+		versions[id]++
+		entries[i].Version = versions[id]
+	}
+	if err := h.append(entries); err != nil {
+		h.versions = nil
+		return err
+	}
+	size, err := h.fileSize()
+	if err != nil {
+		h.versions = nil
+		return nil
+	}
+	for id, version := range versions {
+		h.versions[id] = version
+	}
+	h.size = size
+	return nil
+}
+
+// append writes the entries and syncs the file once
+func (h *changeLog) append(entries []historyEntry) error {
+	var data []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("ошибка кодирования истории: %v", err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+	file, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия истории: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("ошибка записи истории: %v", err)
+	}
+	return file.Sync()
+}
+
+// recordChange adds the next version of a book to the history. The change
+// itself is already stored, so a failure is only logged. Nothing is recorded
+// when history is turned off in the config
+func recordChange(action string, before, after *Book, client string) {
+	if !config.History {
+		return
+	}
+	entry := newHistoryEntry(action, before, after, client)
+	if err := history.add(entry); err != nil {
+		log.Printf("Ошибка записи истории книги %s: %v", entry.BookID, err)
+	}
+}
+
+func newHistoryEntry(action string, before, after *Book, client string) historyEntry {
+	id := ""
+	if after != nil {
+		id = after.ID
+	} else if before != nil {
+		id = before.ID
+	}
+	return historyEntry{
+		BookID: id,
+		Action: action,
+		At:     time.Now(),
+		By:     client,
+		Before: before,
+		After:  after,
+	}
+}
+
+// recordReplacement records the difference between the books before and
+// after the whole database was replaced: new IDs as created, changed books
+// as updated and the missing ones as deleted, in one write to the history
+func recordReplacement(old, books []Book, client string) {
+	if !config.History {
+		return
+	}
+	before := make(map[string]Book, len(old))
+	for _, book := range old {
+		before[book.ID] = book
+	}
+	var entries []historyEntry
+	for i := range books {
+		prev, ok := before[books[i].ID]
+		switch {
+		case !ok:
+			entries = append(entries, newHistoryEntry(historyCreate, nil, &books[i], client))
+		case prev != books[i]:
+			entries = append(entries, newHistoryEntry(historyUpdate, &prev, &books[i], client))
+		}
+		delete(before, books[i].ID)
+	}
+	for _, book := range old {
+		if prev, ok := before[book.ID]; ok {
+			entries = append(entries, newHistoryEntry(historyDelete, &prev, nil, client))
+			delete(before, book.ID)
+		}
+	}
+	if len(entries) == 0 {
+		return
+	}
+	if err := history.add(entries...); err != nil {
+		log.Printf("Ошибка записи истории замены базы: %v", err)
+	}
+}
+
+// bookHistory returns every version of a book, including deleted books
+func bookHistory(id string) ([]historyEntry, error) {
+	unlock, err := lockDB(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries, err := history.entries(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errBookNotFound
+	}
+	return entries, nil
+}
+
+// versionOf returns the book as it was after version; version 0 is the
+// state before the book was created
+func versionOf(entries []historyEntry, version int) (*Book, error) {
+	if version == 0 {
+		return nil, nil
+	}
+	for _, entry := range entries {
+		if entry.Version == version {
+			return entry.After, nil
+		}
+	}
+	return nil, errVersionNotFound
+}
+
+// diffBooks lists the fields that differ between a and b; nil is a book
+// with every field empty
+func diffBooks(a, b *Book) []fieldChange {
+	changes := []fieldChange{}
+	for _, field := range bookFields {
+		var from, to string
+		if a != nil {
+			from = a.getField(field)
+		}
+		if b != nil {
+			to = b.getField(field)
+		}
+		if from != to {
+			changes = append(changes, fieldChange{Field: field, From: from, To: to})
+		}
+	}
+	return changes
+}
+
+// diffVersions compares two versions of a book
+func diffVersions(id string, from, to int) ([]fieldChange, error) {
+	entries, err := bookHistory(id)
+	if err != nil {
+		return nil, err
+	}
+	a, err := versionOf(entries, from)
+	if err != nil {
+		return nil, &FieldError{Field: "from", Err: err}
+	}
+	b, err := versionOf(entries, to)
+	if err != nil {
+		return nil, &FieldError{Field: "to", Err: err}
+	}
+	return diffBooks(a, b), nil
+}
+
+// revertBook sets the book back to the values it had after version. Every
+// field goes through setField like in the update dialogue, so a version that
+// no longer passes validation (e.g. a date now in the future) is refused, and
+// checkReplacement refuses a name and authors another book took since then
+func revertBook(id string, version int, client string) (Book, error) {
+	unlock, err := lockDB(true)
+	if err != nil {
+		return Book{}, err
+	}
+	defer unlock()
+
+	entries, err := history.entries(id)
+	if err != nil {
+		return Book{}, err
+	}
+	target, err := versionOf(entries, version)
+	if err != nil {
+		return Book{}, &FieldError{Field: "version", Err: err}
+	}
+	if target == nil {
+		return Book{}, &FieldError{Field: "version", Err: fmt.Errorf("в версии %d книги нет", version)}
+	}
+
+	current, err := store.Get(id)
+	if err != nil {
+		return Book{}, err
+	}
+	book := current
+	for _, field := range editableFields {
+		if err := book.setField(field, target.getField(field)); err != nil {
+			return Book{}, &FieldError{Field: field, Err: err}
+		}
+	}
+	if book == current {
+		return book, nil
+	}
+	if err := checkReplacement(book); err != nil {
+		return Book{}, err
+	}
+
+	if err := store.Replace(book); err != nil {
+		return Book{}, err
+	}
+	recordChange(historyRevert, &current, &book, client)
+	log.Printf("Книга %s (ID: %s) возвращена к версии %d клиентом %s", book.Name, book.ID, version, client)
+	return book, nil
+}
+
+func formatHistory(entries []historyEntry) string {
+	var builder strings.Builder
+	builder.WriteString("\nИстория изменений:\n")
+	builder.WriteString(strings.Repeat("-", 50) + "\n")
+	for _, entry := range entries {
+		builder.WriteString(fmt.Sprintf("Версия %d: %s, %s, клиент: %s\n",
+			entry.Version, entry.Action, entry.At.Format("02-01-2006 15:04:05"), entry.By))
+		for _, change := range diffBooks(entry.Before, entry.After) {
+			builder.WriteString(fmt.Sprintf("  %s: %q -> %q\n", change.Field, change.From, change.To))
+		}
+		builder.WriteString(strings.Repeat("-", 50) + "\n")
+	}
+	return builder.String()
+}
+
+func formatDiff(changes []fieldChange) string {
+	if len(changes) == 0 {
+		return "Версии не отличаются"
+	}
+	var builder strings.Builder
+	for _, change := range changes {
+		builder.WriteString(fmt.Sprintf("%s: %q -> %q\n", change.Field, change.From, change.To))
+	}
+	return builder.String()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// TestHistoryVersions checks that versions keep counting when the history is
+// written by another process between two writes of this one
+func TestHistoryVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.history")
+	ours := &changeLog{path: path}
+	theirs := &changeLog{path: path}
+
+	book := benchBook(1)
+	for _, h := range []*changeLog{ours, ours, theirs, ours} {
+		if err := h.add(newHistoryEntry(historyUpdate, &book, &book, "test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := ours.entries(book.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range entries {
+		if entry.Version != i+1 {
+			t.Errorf("запись %d имеет версию %d", i+1, entry.Version)
+		}
+	}
+}
+
+// TestRecordReplacement checks the entries a replace of the whole database
+// leaves in the history
+func TestRecordReplacement(t *testing.T) {
+	useMemoryDatabase(t)
+
+	kept, changed, removed := benchBook(1), benchBook(2), benchBook(3)
+	updated := changed
+	updated.Score = "5"
+	added := benchBook(4)
+	recordReplacement([]Book{kept, changed, removed}, []Book{kept, updated, added}, "test")
+
+	want := map[string]string{"2": historyUpdate, "3": historyDelete, "4": historyCreate}
+	for _, id := range []string{"1", "2", "3", "4"} {
+		entries, err := history.entries(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case want[id] == "" && len(entries) != 0:
+			t.Errorf("книга %s не менялась, но попала в историю", id)
+		case want[id] != "" && (len(entries) != 1 || entries[0].Action != want[id]):
+			t.Errorf("книга %s: %+v, ожидалось одно действие %s", id, entries, want[id])
+		}
+	}
+}
+
+// TestRevertRefusesDuplicateTitle checks that a book can't be reverted to a
+// name and authors another book has taken since that version
+func TestRevertRefusesDuplicateTitle(t *testing.T) {
+	useMemoryDatabase(t)
+
+	book, err := createBook(newTestBook("Старое название"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := patchBook(book.ID, bookPatch{"name": "Новое название"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createBook(newTestBook("Старое название"), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := revertBook(book.ID, 1, "test"); !errors.Is(err, errBookExists) {
+		t.Fatalf("откат к названию другой книги: %v, ожидалось %v", err, errBookExists)
+	}
+	current, err := store.Get(book.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Name != "Новое название" {
+		t.Errorf("после отклоненного отката название %q", current.Name)
+	}
+	entries, err := history.entries(book.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("отклоненный откат записан в историю: %d версий", len(entries))
+	}
+}
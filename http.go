@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newHTTPHandler exposes the catalogue as a REST API on top of the same
+// functions the TCP menu and the JSON protocol use
+func newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/books", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleListBooks(w, r)
+		case http.MethodPost:
+			handleCreateBook(w, r)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+	})
+	mux.HandleFunc("/books/", func(w http.ResponseWriter, r *http.Request) {
+		// /books/{id} и /books/{id}/history, /diff, /revert
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/books/"), "/")
+		if id == "" || strings.Contains(action, "/") {
+			writeError(w, errorResponse(codeNotFound, errBookNotFound))
+			return
+		}
+		if action != "" {
+			handleBookHistory(w, r, id, action)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			handleGetBook(w, id)
+		case http.MethodPatch:
+			handleUpdateBook(w, r, id)
+		case http.MethodDelete:
+			handleDeleteBook(w, r, id)
+		default:
+			methodNotAllowed(w, "GET, PATCH, DELETE")
+		}
+	})
+	mux.HandleFunc("/trash", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			entries, err := listTrash()
+			if err != nil {
+				writeError(w, storageErrorResponse(err))
+				return
+			}
+			writeJSON(w, http.StatusOK, okResponse(nonNilTrash(entries)))
+		case http.MethodDelete:
+			handlePurgeTrash(w, r, nil)
+		default:
+			methodNotAllowed(w, "GET, DELETE")
+		}
+	})
+	mux.HandleFunc("/trash/", func(w http.ResponseWriter, r *http.Request) {
+		// /trash/{id} и /trash/{id}/restore
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/trash/"), "/")
+		switch {
+		case id == "" || (action != "" && action != "restore"):
+			writeError(w, errorResponse(codeNotFound, errNotInTrash))
+		case action == "restore" && r.Method == http.MethodPost:
+			book, err := restoreFromTrash(id, requestClient(r))
+			if err != nil {
+				writeError(w, storageErrorResponse(err))
+				return
+			}
+			writeJSON(w, http.StatusOK, okResponse(book))
+		case action == "restore":
+			methodNotAllowed(w, "POST")
+		case r.Method == http.MethodDelete:
+			handlePurgeTrash(w, r, []string{id})
+		default:
+			methodNotAllowed(w, "DELETE")
+		}
+	})
+	mux.HandleFunc("/import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		handleImport(w, r)
+	})
+	mux.HandleFunc("/dump", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		dump, err := dumpDatabase()
+		if err != nil {
+			writeError(w, storageErrorResponse(err))
+			return
+		}
+		// Дамп отдается без конверта, чтобы его можно было сразу загрузить в /restore
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="books.json"`)
+		if err := json.NewEncoder(w).Encode(dump); err != nil {
+			log.Printf("Ошибка записи HTTP ответа: %v", err)
+		}
+	})
+	mux.HandleFunc("/restore", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		handleRestore(w, r)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		stats, err := libraryStatistics()
+		if err != nil {
+			writeError(w, storageErrorResponse(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, okResponse(stats))
+	})
+	return logRequests(requireLogin(mux))
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeJSON(w, http.StatusMethodNotAllowed, errorResponse(codeBadRequest, errors.New("метод не поддерживается")))
+}
+
+// newHTTPServer serves the API over HTTPS with the same certificates as the
+// TCP server when tlsConfig is not nil
+func newHTTPServer(tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:              config.HTTPListen,
+		Handler:           newHTTPHandler(),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       time.Duration(config.IdleTimeout),
+	}
+}
+
+func serveHTTP(server *http.Server) {
+	var err error
+	if server.TLSConfig != nil {
+		log.Printf("HTTP API слушает на %s (TLS)", server.Addr)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("HTTP API слушает на %s", server.Addr)
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Ошибка HTTP сервера: %v", err)
+	}
+}
+
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s HTTP %s %s", r.RemoteAddr, r.Method, r.URL.RequestURI())
+		next.ServeHTTP(w, r)
+	})
+}
+
+type clientKey struct{}
+
+// requireLogin checks HTTP Basic credentials against the same accounts as
+// the TCP login and the user's role against routeRole. While there are no
+// accounts every request is anonymous with anonymousRole
+func requireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required, err := authRequired()
+		if err != nil {
+			writeError(w, errorResponse(codeInternal, err))
+			return
+		}
+		acc := account{Name: r.RemoteAddr, Role: anonymousRole}
+		if required {
+			name, password, ok := r.BasicAuth()
+			if ok {
+				acc, err = verifiedCredentials.authenticate(r.Header.Get("Authorization"), name, password)
+			} else {
+				err = errBadCredentials
+			}
+			if errors.Is(err, errBadCredentials) {
+				log.Printf("%s HTTP: вход не выполнен", r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Basic realm="books", charset="UTF-8"`)
+				writeError(w, errorResponse(codeUnauthorized, err))
+				return
+			}
+			if err != nil {
+				writeError(w, errorResponse(codeInternal, err))
+				return
+			}
+		}
+		if required := routeRole(r); !acc.Role.allows(required) {
+			log.Printf("%s (%s): отказано в %s %s", acc.Name, acc.Role, r.Method, r.URL.Path)
+			writeError(w, errorResponse(codeForbidden, errForbidden))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientKey{}, acc.Name)))
+	})
+}
+
+// credentialTTL is how long a verified Authorization header is trusted
+// without checking the password again
+const credentialTTL = time.Minute
+
+// maxCachedCredentials bounds the cache; it is emptied when full
+const maxCachedCredentials = 1024
+
+// credentialCache remembers recently verified Authorization headers, so a
+// client that sends its credentials with every request pays for PBKDF2 once
+// a minute rather than every time. Headers are kept as SHA-256 hashes, and
+// the whole cache is dropped as soon as the users file changes, so useradd,
+// userdel and usermod still take effect at once
+type credentialCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]cachedCredential
+	// users is the users file the entries were verified against
+	users os.FileInfo
+}
+
+type cachedCredential struct {
+	acc     account
+	expires time.Time
+}
+
+var verifiedCredentials = &credentialCache{}
+
+// authenticate returns the account for the header, checking name and
+// password with the slow authenticate only if the header isn't cached
+func (c *credentialCache) authenticate(header, name, password string) (account, error) {
+	key := sha256.Sum256([]byte(header))
+	users, err := statFile(usersPath)
+	if err != nil {
+		return account{}, err
+	}
+
+	c.mu.Lock()
+	if !sameFileState(c.users, users) {
+		c.entries, c.users = nil, users
+	}
+	cached, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.acc, nil
+	}
+
+	acc, err := authenticate(name, password)
+	if err != nil {
+		return acc, err
+	}
+	c.mu.Lock()
+	if c.entries == nil || len(c.entries) >= maxCachedCredentials {
+		c.entries = make(map[[sha256.Size]byte]cachedCredential)
+	}
+	if sameFileState(c.users, users) {
+		c.entries[key] = cachedCredential{acc: acc, expires: time.Now().Add(credentialTTL)}
+	}
+	c.mu.Unlock()
+	return acc, nil
+}
+
+// routeRole returns the role a request needs, following the menu: reading is
+// open to readers, adding, updating and reverting to editors, and deleting,
+// the trash, import, dump and restore to admins
+func routeRole(r *http.Request) role {
+	path := r.URL.Path
+	switch {
+	case path == "/import" || path == "/dump" || path == "/restore" ||
+		path == "/trash" || strings.HasPrefix(path, "/trash/"):
+		return roleAdmin
+	case strings.HasPrefix(path, "/books/") && r.Method == http.MethodDelete:
+		return roleAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return roleReader
+	case path == "/books" || strings.HasPrefix(path, "/books/"):
+		return roleEditor
+	}
+	return roleReader
+}
+
+// requestClient names who made the request: the user, or the address when
+// no login is required
+func requestClient(r *http.Request) string {
+	if name, ok := r.Context().Value(clientKey{}).(string); ok {
+		return name
+	}
+	return r.RemoteAddr
+}
+
+// httpStatus maps JSON protocol error codes to HTTP status codes
+func httpStatus(code string) int {
+	switch code {
+	case codeBadRequest, codeUnknownOp:
+		return http.StatusBadRequest
+	case codeValidation:
+		return http.StatusUnprocessableEntity
+	case codeDuplicate:
+		return http.StatusConflict
+	case codeNotFound:
+		return http.StatusNotFound
+	case codeUnauthorized:
+		return http.StatusUnauthorized
+	case codeForbidden:
+		return http.StatusForbidden
+	case codeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case codeLocked, codeShutdown:
+		return http.StatusServiceUnavailable
+	case codeTimeout:
+		return http.StatusRequestTimeout
+	case codeInternal:
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp jsonResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Ошибка записи HTTP ответа: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, resp jsonResponse) {
+	writeJSON(w, httpStatus(resp.Code), resp)
+}
+
+// limitBody caps the request body at config.MaxBodySize; reading past the
+// limit fails with *http.MaxBytesError
+func limitBody(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxBodySize)
+}
+
+// bodyError is the response to a request body that could not be read or decoded
+func bodyError(err error) jsonResponse {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errorResponse(codeTooLarge, fmt.Errorf("тело запроса больше %d байт", tooLarge.Limit))
+	}
+	return errorResponse(codeBadRequest, fmt.Errorf("некорректное тело запроса: %v", err))
+}
+
+// decodeBook reads a book from the body; see bodyError for the errors
+func decodeBook(w http.ResponseWriter, r *http.Request) (Book, error) {
+	var book Book
+	limitBody(w, r)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&book)
+	return book, err
+}
+
+// handleListBooks returns every book, the result of a query language
+// search for ?q=..., of a range search for ?range=field&min=..&max=..
+// (also after, before) or of findBooks for a single field=value pair
+// (&exact=true for whole values)
+func handleListBooks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	asCSV := query.Get("format") == "csv"
+	exact := query.Get("exact") == "true"
+	query.Del("format")
+	query.Del("exact")
+	opts, err := parseListOptions(query)
+	if err != nil {
+		writeError(w, storageErrorResponse(err))
+		return
+	}
+	if query.Has("q") || query.Has("range") {
+		var q Query
+		if query.Has("q") {
+			q, err = ParseQuery(query.Get("q"))
+			if err != nil {
+				err = &FieldError{Field: "q", Err: err}
+			}
+		} else {
+			q, err = RangeQuery(query.Get("range"), rangeBounds{
+				Min:    query.Get("min"),
+				Max:    query.Get("max"),
+				After:  query.Get("after"),
+				Before: query.Get("before"),
+			})
+			if err != nil {
+				err = &FieldError{Field: query.Get("range"), Err: err}
+			}
+		}
+		if err != nil {
+			writeError(w, errorResponse(codeValidation, err))
+			return
+		}
+		books, err := queryBooks(q)
+		if err != nil {
+			writeError(w, storageErrorResponse(err))
+			return
+		}
+		writeList(w, books, opts, asCSV)
+		return
+	}
+	if len(query) == 0 {
+		books, err := Read()
+		if err != nil {
+			writeError(w, storageErrorResponse(err))
+			return
+		}
+		writeList(w, books, opts, asCSV)
+		return
+	}
+
+	if len(query) > 1 {
+		writeError(w, errorResponse(codeBadRequest, errors.New("поиск поддерживает только одно поле")))
+		return
+	}
+	for field := range query {
+		if !contains(bookFields, field) {
+			writeError(w, errorResponse(codeValidation, &FieldError{Field: field, Err: errors.New("неизвестное поле: " + field)}))
+			return
+		}
+		books, err := findBooks(field, query.Get(field), exact)
+		if err != nil {
+			writeError(w, storageErrorResponse(err))
+			return
+		}
+		writeList(w, books, opts, asCSV)
+	}
+}
+
+// parseListOptions takes the sort, page and size parameters out of query
+func parseListOptions(query url.Values) (listOptions, error) {
+	opts := listOptions{Sort: query.Get("sort")}
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"page", &opts.Page}, {"size", &opts.Size}} {
+		if !query.Has(param.name) {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(param.name))
+		if err != nil {
+			return opts, &FieldError{Field: param.name, Err: errors.New("должно быть целым числом")}
+		}
+		*param.value = n
+	}
+	query.Del("sort")
+	query.Del("page")
+	query.Del("size")
+	return opts, nil
+}
+
+// writeList writes a list of books as JSON, or as CSV when asCSV is set
+func writeList(w http.ResponseWriter, books []Book, opts listOptions, asCSV bool) {
+	resp := listResponse(books, opts)
+	if resp.Status == "error" {
+		writeError(w, resp)
+		return
+	}
+	if !asCSV {
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="books.csv"`)
+	if err := exportCSV(w, resp.Data.([]Book)); err != nil {
+		log.Printf("Ошибка выгрузки CSV: %v", err)
+	}
+}
+
+// handlePurgeTrash deletes books from the trash for good; nil ids empties it
+func handlePurgeTrash(w http.ResponseWriter, r *http.Request, ids []string) {
+	purged, err := purgeTrash(ids)
+	if err != nil {
+		writeError(w, storageErrorResponse(err))
+		return
+	}
+	if len(ids) > 0 && len(purged) == 0 {
+		writeError(w, errorResponse(codeNotFound, errNotInTrash))
+		return
+	}
+	log.Printf("%s удалил из корзины навсегда книг: %d", requestClient(r), len(purged))
+	writeJSON(w, http.StatusOK, okResponse(nonNilTrash(purged)))
+}
+
+// handleImport adds books from a CSV body; ?map= maps columns to fields
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	mapping, err := parseCSVMapping(r.URL.Query().Get("map"))
+	if err != nil {
+		writeError(w, errorResponse(codeBadRequest, err))
+		return
+	}
+	// Файл читается целиком до импорта, чтобы слишком большой не был
+	// импортирован наполовину
+	limitBody(w, r)
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, bodyError(err))
+		return
+	}
+	report, err := importCSV(bytes.NewReader(data), mapping, requestClient(r))
+	if errors.Is(err, errInvalidCSV) {
+		writeError(w, errorResponse(codeBadRequest, err))
+		return
+	}
+	if err != nil && len(report.Rows) == 0 {
+		writeError(w, storageErrorResponse(err))
+		return
+	}
+	if err != nil {
+		log.Printf("Импорт CSV прерван: %v", err)
+	}
+	writeJSON(w, http.StatusOK, okResponse(report))
+}
+
+// handleRestore loads a dump from the body; ?mode= is merge (default) or replace
+func handleRestore(w http.ResponseWriter, r *http.Request) {
+	var dump databaseDump
+	limitBody(w, r)
+	if err := json.NewDecoder(r.Body).Decode(&dump); err != nil {
+		writeError(w, bodyError(err))
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = restoreMerge
+	}
+
+	report, err := restoreDatabase(dump, mode, requestClient(r))
+	if errors.Is(err, errDumpRejected) {
+		resp := errorResponse(codeValidation, err)
+		resp.Data = report
+		writeError(w, resp)
+		return
+	}
+	if err != nil && len(report.Rows) == 0 {
+		writeError(w, storageErrorResponse(err))
+		return
+	}
+	if err != nil {
+		log.Printf("Восстановление дампа прервано: %v", err)
+	}
+	writeJSON(w, http.StatusOK, okResponse(report))
+}
+
+func handleGetBook(w http.ResponseWriter, id string) {
+	books, err := searchBooks("id", id)
+	if err != nil {
+		writeError(w, storageErrorResponse(err))
+		return
+	}
+	if len(books) == 0 {
+		writeError(w, errorResponse(codeNotFound, errBookNotFound))
+		return
+	}
+	writeJSON(w, http.StatusOK, okResponse(books[0]))
+}
+
+func handleCreateBook(w http.ResponseWriter, r *http.Request) {
+	book, err := decodeBook(w, r)
+	if err != nil {
+		writeError(w, bodyError(err))
+		return
+	}
+	book, err = validateBook(book)
+	if err != nil {
+		writeError(w, storageErrorResponse(err))
+		return
+	}
+	created, err := createBook(book, requestClient(r))
+	if err != nil {
+		writeError(w, storageErrorResponse(err))
+		return
+	}
+	w.Header().Set("Location", "/books/"+created.ID)
+	writeJSON(w, http.StatusCreated, okResponse(created))
+}
+
+func handleUpdateBook(w http.ResponseWriter, r *http.Request, id string) {
+	var patch bookPatch
+	limitBody(w, r)
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, bodyError(err))
+		return
+	}
+	book, err := patchBook(id, patch, requestClient(r))
+	if err != nil {
+		writeError(w, storageErrorResponse(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, okResponse(book))
+}
+
+func handleDeleteBook(w http.ResponseWriter, r *http.Request, id string) {
+	deleted, err := modifyBooks([]Book{{ID: id}}, false, requestClient(r))
+	if err != nil {
+		writeError(w, storageErrorResponse(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, okResponse(deleted))
+}
+
+// handleBookHistory serves GET /books/{id}/history, GET /books/{id}/diff?from=&to=
+// and POST /books/{id}/revert?version=
+func handleBookHistory(w http.ResponseWriter, r *http.Request, id, action string) {
+	method := http.MethodGet
+	if action == "revert" {
+		method = http.MethodPost
+	}
+	switch {
+	case action != "history" && action != "diff" && action != "revert":
+		writeError(w, errorResponse(codeNotFound, errBookNotFound))
+		return
+	case r.Method != method:
+		methodNotAllowed(w, method)
+		return
+	}
+
+	// Номера версий из строки запроса; отсутствующий параметр равен 0
+	versions := make(map[string]int)
+	for _, name := range []string{"from", "to", "version"} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			writeError(w, errorResponse(codeBadRequest, &FieldError{Field: name, Err: errors.New("версия должна быть числом")}))
+			return
+		}
+		versions[name] = n
+	}
+
+	var data interface{}
+	var err error
+	switch action {
+	case "history":
+		data, err = bookHistory(id)
+	case "diff":
+		data, err = diffVersions(id, versions["from"], versions["to"])
+	case "revert":
+		data, err = revertBook(id, versions["version"], requestClient(r))
+	}
+	if err != nil {
+		writeError(w, storageErrorResponse(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, okResponse(data))
+}
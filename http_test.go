@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestHTTPRoles checks routeRole through the HTTP API: anonymous requests
+// only read while there are no accounts, then every request needs a login
+// and an account with the required role
+func TestHTTPRoles(t *testing.T) {
+	useMemoryDatabase(t)
+	handler := newHTTPHandler()
+
+	request := func(method, path, user string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{}`))
+		if user != "" {
+			req.SetBasicAuth(user, testPassword)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := request(http.MethodGet, "/books", ""); code != http.StatusOK {
+		t.Errorf("анонимный GET /books: %d", code)
+	}
+	for _, path := range []string{"/books", "/import", "/restore"} {
+		if code := request(http.MethodPost, path, ""); code != http.StatusForbidden {
+			t.Errorf("анонимный POST %s: %d, ожидался 403", path, code)
+		}
+	}
+
+	if err := addUser("reader", testPassword, roleReader); err != nil {
+		t.Fatal(err)
+	}
+	if err := addUser(testAdmin, testPassword, roleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		method, path, user string
+		want               int
+	}{
+		{http.MethodGet, "/books", "", http.StatusUnauthorized},
+		{http.MethodGet, "/books", "reader", http.StatusOK},
+		{http.MethodPost, "/books", "reader", http.StatusForbidden},
+		{http.MethodDelete, "/books/1", "reader", http.StatusForbidden},
+		{http.MethodDelete, "/books/1", testAdmin, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		if code := request(c.method, c.path, c.user); code != c.want {
+			t.Errorf("%s %s от %q: %d, ожидался %d", c.method, c.path, c.user, code, c.want)
+		}
+	}
+}
+
+// TestHTTPPatchChecksWholeBook checks that PATCH refuses a merged book that
+// fails validation with 422 and a name and authors of another book with 409
+func TestHTTPPatchChecksWholeBook(t *testing.T) {
+	useMemoryDatabase(t)
+	if err := addUser(testAdmin, testPassword, roleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	handler := newHTTPHandler()
+
+	request := func(method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth(testAdmin, testPassword)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, name := range []string{"Первая книга", "Вторая книга"} {
+		body := `{"name":"` + name + `","authors":"Тестовый Автор","genres":"Роман","year":"2000",` +
+			`"width":"100","height":"200","cover":"мягкий","source":"покупка","added":"01-01-2020"}`
+		if code := request(http.MethodPost, "/books", body); code != http.StatusCreated {
+			t.Fatalf("POST /books %s: %d", name, code)
+		}
+	}
+
+	cases := []struct {
+		path, body string
+		want       int
+	}{
+		{"/books/1", `{"year":"2024"}`, http.StatusUnprocessableEntity},
+		{"/books/2", `{"name":"Первая книга"}`, http.StatusConflict},
+		{"/books/2", `{"score":"7"}`, http.StatusOK},
+	}
+	for _, c := range cases {
+		if code := request(http.MethodPatch, c.path, c.body); code != c.want {
+			t.Errorf("PATCH %s %s: %d, ожидался %d", c.path, c.body, code, c.want)
+		}
+	}
+}
+
+// TestHTTPStatus checks the status of every JSON protocol error code; the
+// codes that mean "try again" have to map to 408 and 503, not 500
+func TestHTTPStatus(t *testing.T) {
+	cases := map[string]int{
+		codeBadRequest:   http.StatusBadRequest,
+		codeUnknownOp:    http.StatusBadRequest,
+		codeValidation:   http.StatusUnprocessableEntity,
+		codeDuplicate:    http.StatusConflict,
+		codeNotFound:     http.StatusNotFound,
+		codeUnauthorized: http.StatusUnauthorized,
+		codeForbidden:    http.StatusForbidden,
+		codeTooLarge:     http.StatusRequestEntityTooLarge,
+		codeLocked:       http.StatusServiceUnavailable,
+		codeShutdown:     http.StatusServiceUnavailable,
+		codeTimeout:      http.StatusRequestTimeout,
+		codeInternal:     http.StatusInternalServerError,
+		"":               http.StatusOK,
+	}
+	for code, want := range cases {
+		if got := httpStatus(code); got != want {
+			t.Errorf("код %q: %d, ожидался %d", code, got, want)
+		}
+	}
+}
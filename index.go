@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// bookIndex describes one state of the books file: where every line starts
+// and which books have a given author, genre, year or name and authors.
+// It is rebuilt whenever the file no longer matches the state it was built
+// from, e.g. after another process wrote to the database
+type bookIndex struct {
+	state    os.FileInfo // nil if the file did not exist
+	version  int
+	offsets  map[string]int64
+	byAuthor map[string][]string
+	byGenre  map[string][]string
+	byYear   map[string][]string
+	byTitle  map[bookTitle]string
+	maxID    int
+}
+
+// bookTitle is the pair that has to be unique among books
+type bookTitle struct {
+	name    string
+	authors string
+}
+
+func newBookIndex(version int) *bookIndex {
+	return &bookIndex{
+		version:  version,
+		offsets:  make(map[string]int64),
+		byAuthor: make(map[string][]string),
+		byGenre:  make(map[string][]string),
+		byYear:   make(map[string][]string),
+		byTitle:  make(map[bookTitle]string),
+	}
+}
+
+// add records the book whose line starts at offset
+func (x *bookIndex) add(book Book, offset int64) {
+	if _, ok := x.offsets[book.ID]; !ok {
+		x.offsets[book.ID] = offset // как и Scan, Get находит первую книгу с ID
+	}
+	for _, author := range indexKeys(book.Authors) {
+		x.byAuthor[author] = append(x.byAuthor[author], book.ID)
+	}
+	for _, genre := range indexKeys(book.Genres) {
+		x.byGenre[genre] = append(x.byGenre[genre], book.ID)
+	}
+	x.byYear[book.Year] = append(x.byYear[book.Year], book.ID)
+	x.byTitle[bookTitle{book.Name, book.Authors}] = book.ID
+	if id, err := strconv.Atoi(book.ID); err == nil && id > x.maxID {
+		x.maxID = id
+	}
+}
+
+// matches reports whether the index still describes the file with this info
+func (x *bookIndex) matches(info os.FileInfo) bool {
+	return sameFileState(x.state, info)
+}
+
+// sameFileState reports whether two stats describe the same unchanged file;
+// nil is a missing file
+func sameFileState(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// indexKeys splits a comma-separated list of authors or genres into
+// normalized entries
+func indexKeys(value string) []string {
+	var keys []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" && !contains(keys, item) {
+			keys = append(keys, item)
+		}
+	}
+	return keys
+}
+
+func statFile(path string) (os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия файла: %v", err)
+	}
+	return info, nil
+}
+
+// currentIndex returns the index of the file as it is now, rebuilding it if
+// the file has changed since the index was built
+func (s *fileStore) currentIndex() (*bookIndex, error) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	info, err := statFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if s.index != nil && s.index.matches(info) {
+		return s.index, nil
+	}
+
+	version, err := s.formatVersion()
+	if err != nil {
+		return nil, err
+	}
+	index := newBookIndex(version)
+	err = s.scanLines(func(book Book, offset int64) bool {
+		index.add(book, offset)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	index.state = info
+	s.index = index
+	return index, nil
+}
+
+// setIndex replaces the index after the store itself has written the file
+func (s *fileStore) setIndex(index *bookIndex) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	info, err := statFile(s.path)
+	if err != nil || index == nil {
+		s.index = nil
+		return
+	}
+	index.state = info
+	s.index = index
+}
+
+// indexAppended adds a book appended at offset to the index, if the index
+// described the file as it was before the append (before)
+func (s *fileStore) indexAppended(before os.FileInfo, book Book, offset int64) {
+	s.indexMu.Lock()
+	index := s.index
+	s.indexMu.Unlock()
+
+	if index == nil || !index.matches(before) {
+		s.setIndex(nil)
+		return
+	}
+	index.add(book, offset)
+	s.setIndex(index)
+}
+
+// readBooks reads the books with the given IDs from their offsets, in file order
+func (s *fileStore) readBooks(index *bookIndex, ids []string) ([]Book, error) {
+	offsets := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if offset, ok := index.offsets[id]; ok {
+			offsets = append(offsets, offset)
+		}
+	}
+	if len(offsets) == 0 {
+		return nil, nil
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия файла: %v", err)
+	}
+	defer file.Close()
+
+	books := make([]Book, 0, len(offsets))
+	for i, offset := range offsets {
+		if i > 0 && offset == offsets[i-1] {
+			continue
+		}
+		if _, err := file.Seek(offset, 0); err != nil {
+			return nil, fmt.Errorf("ошибка чтения файла: %v", err)
+		}
+		line, err := bufio.NewReader(file).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("ошибка чтения файла: %v", err)
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		book, err := lineToBook(line, index.version)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка парсинга строки: %v", err)
+		}
+		books = append(books, book)
+	}
+	return books, nil
+}
+
+// Lookup finds books through the index with the same matching rules as
+// findBooks: authors and genres by case-insensitive substring, or by a whole
+// entry of the list when exact is set; year always exactly. ok is false when
+// the index can't answer and the caller has to scan.
+// A substring search still checks every author or genre key, so its cost
+// grows with the number of distinct authors or genres rather than with the
+// number of matches; it only skips parsing the lines that don't match
+func (s *fileStore) Lookup(field, value string, exact bool) ([]Book, bool, error) {
+	if field != "year" && field != "authors" && field != "genres" {
+		return nil, false, nil
+	}
+
+	// Подстрока с запятой или пробелами по краям может захватить границу
+	// между элементами списка - такие запросы ищутся полным просмотром
+	needle := strings.ToLower(value)
+	if exact {
+		needle = strings.TrimSpace(needle)
+	}
+	if field != "year" && (needle == "" || strings.Contains(needle, ",") || strings.TrimSpace(needle) != needle) {
+		return nil, false, nil
+	}
+
+	index, err := s.currentIndex()
+	if err != nil {
+		return nil, true, err
+	}
+
+	var ids []string
+	switch field {
+	case "year":
+		ids = index.byYear[value]
+	case "authors", "genres":
+		keys := index.byAuthor
+		if field == "genres" {
+			keys = index.byGenre
+		}
+		if exact {
+			ids = keys[needle]
+			break
+		}
+		// Подстроку приходится сравнивать с каждым ключом индекса
+		for key, keyIDs := range keys {
+			if strings.Contains(key, needle) {
+				ids = append(ids, keyIDs...)
+			}
+		}
+	}
+	books, err := s.readBooks(index, ids)
+	return books, true, err
+}
+
+// FindByTitle returns the ID of the book with exactly this name and authors
+func (s *fileStore) FindByTitle(name, authors string) (string, bool, error) {
+	index, err := s.currentIndex()
+	if err != nil {
+		return "", false, err
+	}
+	id, ok := index.byTitle[bookTitle{name, authors}]
+	return id, ok, nil
+}
+
+func (s *fileStore) maxID() (int, error) {
+	index, err := s.currentIndex()
+	if err != nil {
+		return 0, err
+	}
+	return index.maxID, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// benchBookCount is the size of the generated database for the benchmarks
+const benchBookCount = 50000
+
+var (
+	benchAuthors = []string{"Лев Толстой", "Федор Достоевский", "Антон Чехов", "Иван Тургенев", "Николай Гоголь"}
+	benchGenres  = []string{"Роман", "Повесть", "Рассказ", "Драма", "Поэзия", "Сатира"}
+)
+
+// benchStore writes a books file of benchBookCount generated books to a
+// temporary directory and returns a store over it with the index built
+func benchStore(b *testing.B) *fileStore {
+	b.Helper()
+	return benchStoreOf(b, benchBook)
+}
+
+// benchStoreOf is benchStore with books made by book
+func benchStoreOf(b *testing.B, book func(int) Book) *fileStore {
+	b.Helper()
+	dir := b.TempDir()
+	path := filepath.Join(dir, "books")
+
+	var builder strings.Builder
+	builder.WriteString(formatHeader(currentFormat))
+	for i := 1; i <= benchBookCount; i++ {
+		builder.WriteString(bookToLine(book(i)) + "\n")
+	}
+	if err := os.WriteFile(path, []byte(builder.String()), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	s := newFileStore(path, filepath.Join(dir, "books.tmp"))
+	if _, err := s.currentIndex(); err != nil {
+		b.Fatal(err)
+	}
+	return s
+}
+
+func benchBook(i int) Book {
+	return Book{
+		ID:      fmt.Sprint(i),
+		Name:    fmt.Sprintf("Книга %d", i),
+		Authors: fmt.Sprintf("%s, Соавтор %d", benchAuthors[i%len(benchAuthors)], i%1000),
+		Genres:  benchGenres[i%len(benchGenres)] + ", " + benchGenres[(i/7)%len(benchGenres)],
+		Year:    fmt.Sprint(1800 + i%200),
+		Width:   "120",
+		Height:  "200",
+		Cover:   "твердый",
+		Source:  "покупка",
+		Added:   "01-01-2020",
+	}
+}
+
+// scanDicts is the lookup as it was before the index: every line of the file
+// goes through lineToDict. It returns how many lines match
+func scanDicts(b *testing.B, path string, match func(map[string]string) bool) int {
+	file, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+
+	found := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if _, ok := parseFormatHeader(line); ok || strings.TrimSpace(line) == "" {
+			continue
+		}
+		dict, err := lineToDict(line, currentFormat)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if match(dict) {
+			found++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		b.Fatal(err)
+	}
+	return found
+}
+
+func benchLookup(b *testing.B, field, value string, exact bool, match func(map[string]string) bool) {
+	benchLookupIn(b, benchStore(b), field, value, exact, match)
+}
+
+func benchLookupIn(b *testing.B, s *fileStore, field, value string, exact bool, match func(map[string]string) bool) {
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, ok, err := s.Lookup(field, value, exact); !ok || err != nil {
+				b.Fatalf("индекс не ответил: %v", err)
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanDicts(b, s.path, match)
+		}
+	})
+}
+
+func BenchmarkLookupID(b *testing.B) {
+	s := benchStore(b)
+	id := fmt.Sprint(benchBookCount / 2)
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.Get(id); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanDicts(b, s.path, func(dict map[string]string) bool { return dict["id"] == id })
+		}
+	})
+}
+
+func BenchmarkLookupAuthorExact(b *testing.B) {
+	benchLookup(b, "authors", "Антон Чехов", true, func(dict map[string]string) bool {
+		return contains(indexKeys(dict["authors"]), "антон чехов")
+	})
+}
+
+func BenchmarkLookupAuthorSubstring(b *testing.B) {
+	benchLookup(b, "authors", "чехов", false, func(dict map[string]string) bool {
+		return strings.Contains(strings.ToLower(dict["authors"]), "чехов")
+	})
+}
+
+// BenchmarkLookupSubstringDistinctAuthors is the worst case of the substring
+// lookup: every book has its own author, so Lookup checks as many index keys
+// as there are books
+func BenchmarkLookupSubstringDistinctAuthors(b *testing.B) {
+	s := benchStoreOf(b, func(i int) Book {
+		book := benchBook(i)
+		book.Authors = fmt.Sprintf("Автор %d", i)
+		return book
+	})
+	benchLookupIn(b, s, "authors", "автор 4999", false, func(dict map[string]string) bool {
+		return strings.Contains(strings.ToLower(dict["authors"]), "автор 4999")
+	})
+}
+
+func BenchmarkLookupGenre(b *testing.B) {
+	benchLookup(b, "genres", "драма", true, func(dict map[string]string) bool {
+		return contains(indexKeys(dict["genres"]), "драма")
+	})
+}
+
+func BenchmarkLookupYear(b *testing.B) {
+	benchLookup(b, "year", "1950", false, func(dict map[string]string) bool {
+		return dict["year"] == "1950"
+	})
+}
+
+// BenchmarkUniqueTitle compares the name and authors check of isUniqueBook
+func BenchmarkUniqueTitle(b *testing.B) {
+	s := benchStore(b)
+	book := benchBook(benchBookCount + 1)
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, found, err := s.FindByTitle(book.Name, book.Authors); found || err != nil {
+				b.Fatalf("книга найдена или ошибка: %v", err)
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanDicts(b, s.path, func(dict map[string]string) bool {
+				return dict["name"] == book.Name && dict["authors"] == book.Authors
+			})
+		}
+	})
+}
+
+// TestLookupMatchesScan checks that the index finds the same books as a
+// full scan, for substring and exact searches
+func TestLookupMatchesScan(t *testing.T) {
+	dir := t.TempDir()
+	s := newFileStore(filepath.Join(dir, "books"), filepath.Join(dir, "books.tmp"))
+	for i := 1; i <= 200; i++ {
+		if err := s.Insert(benchBook(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		field, value string
+		exact        bool
+	}{
+		{"authors", "чехов", false},
+		{"authors", "Антон Чехов", true},
+		{"authors", "Чехов", true},
+		{"authors", "соавтор 1", false},
+		{"authors", "Соавтор 1", true},
+		{"genres", "Драма", true},
+		{"genres", "ма", false},
+		{"year", "1950", false},
+	}
+	for _, c := range cases {
+		books, ok, err := s.Lookup(c.field, c.value, c.exact)
+		if err != nil || !ok {
+			t.Fatalf("%s=%q: индекс не ответил: %v", c.field, c.value, err)
+		}
+		want := 0
+		s.Scan(func(book Book) bool {
+			if fieldMatches(book.getField(c.field), c.field, c.value, c.exact) {
+				want++
+			}
+			return true
+		})
+		if len(books) != want {
+			t.Errorf("%s=%q exact=%v: индекс нашел %d, просмотр %d", c.field, c.value, c.exact, len(books), want)
+		}
+	}
+}
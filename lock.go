@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dbMu guards the store: Read and searchBooks share it, Create, Update and
+// modifyBooks hold it exclusively so readers never see a half-applied write
+var dbMu sync.RWMutex
+
+// lockTimeout is how long an operation waits for another process to release the database
+var lockTimeout = 5 * time.Second
+
+const lockRetryInterval = 50 * time.Millisecond
+
+// lockable is implemented by stores that other processes can open at the same time
+type lockable interface {
+	Lock(exclusive bool) (unlock func(), err error)
+}
+
+// LockedError is returned when the database stays locked by another process
+// for longer than lockTimeout
+type LockedError struct {
+	PID int
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return "база данных заблокирована другим процессом"
+	}
+	return fmt.Sprintf("база данных заблокирована процессом PID %d", e.PID)
+}
+
+// fileLock is an advisory lock on a sidecar file next to the database
+type fileLock struct {
+	path string
+}
+
+// lockDB takes dbMu and, if the store is shared between processes, its
+// cross-process lock. The returned function releases both
+func lockDB(exclusive bool) (func(), error) {
+	if exclusive {
+		dbMu.Lock()
+	} else {
+		dbMu.RLock()
+	}
+	release := func() {
+		if exclusive {
+			dbMu.Unlock()
+		} else {
+			dbMu.RUnlock()
+		}
+	}
+
+	l, ok := store.(lockable)
+	if !ok {
+		return release, nil
+	}
+	unlock, err := l.Lock(exclusive)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		release()
+	}, nil
+}
+
+// readLockPID returns the PID written by the exclusive holder, or 0
+func readLockPID(file *os.File) int {
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, 32))
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
@@ -2,14 +2,19 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -24,10 +29,13 @@ var regexSchema = map[string]string{
 	"source":  `^(покупка|подарок|наследство)$`,
 	"added":   `^\d{2}-\d{2}-\d{4}$`,
 	"read":    `^\d{2}-\d{2}-\d{4}$`,
-	"rating":  `^([1-9]|10)/10 - [А-Яа-яЁёA-Za-z0-9\s\,\.\!\?]{1,200}$`,
+	"score":   `^([1-9]|10)$`,
+	"review":  `^[А-Яа-яЁёA-Za-z0-9\s\,\.\!\?]{1,200}$`,
 }
 
-var token = make(chan struct{}, 1)
+// createDelay is an artificial pause inside Create that makes the locking
+// visible when several clients add books at once. Off unless -create-delay is set
+var createDelay time.Duration
 
 func ValidateRegex(field, value string) error {
 	pattern, ok := regexSchema[field]
@@ -56,8 +64,8 @@ func ValidateYear(year string) error {
 	if yearInt > currentYear {
 		return errors.New("год не может быть больше текущего")
 	}
-	if yearInt < 1500 {
-		return errors.New("год не может быть меньше 1500")
+	if yearInt < config.MinYear {
+		return fmt.Errorf("год не может быть меньше %d", config.MinYear)
 	}
 	return nil
 }
@@ -77,8 +85,8 @@ func ValidateHeightWidth(value, heightOrWidth string) error {
 		return err
 	}
 
-	if val > 1000 {
-		return fmt.Errorf("%s обложка не может быть больше метра", heightOrWidth)
+	if val > config.MaxCoverSize {
+		return fmt.Errorf("%s обложка не может быть больше %g мм", heightOrWidth, config.MaxCoverSize)
 	}
 	if val <= 0 {
 		return fmt.Errorf("%s обложка может быть только положительной", heightOrWidth)
@@ -135,12 +143,22 @@ func ValidateRead(read, added string) error {
 	return nil
 }
 
-func ValidateRating(rating string) error {
-	if rating == "" {
+func ValidateScore(score string) error {
+	if score == "" {
 		return nil
 	}
-	if err := ValidateRegex("rating", rating); err != nil {
-		return fmt.Errorf("рейтинг должен быть в формате 'X/10 - комментарий' (например: '8/10 - отличная книга')")
+	if err := ValidateRegex("score", score); err != nil {
+		return fmt.Errorf("оценка должна быть целым числом от 1 до 10")
+	}
+	return nil
+}
+
+func ValidateReview(review string) error {
+	if review == "" {
+		return nil
+	}
+	if err := ValidateRegex("review", review); err != nil {
+		return fmt.Errorf("отзыв может содержать до 200 букв, цифр, пробелов и знаков , . ! ?")
 	}
 	return nil
 }
@@ -206,101 +224,101 @@ func ValidateGenres(genres string) (string, error) {
 	return normalized, nil
 }
 
+// isUniqueBook reports whether no other stored book has the same name and
+// authors; the stored book with the same ID as book doesn't count.
+// The caller must hold the exclusive lockDB lock
 func isUniqueBook(book Book) (bool, error) {
-	if _, err := os.Stat(FILENAME); os.IsNotExist(err) {
-		return true, nil // файла не существует
+	if ix, ok := store.(indexed); ok {
+		id, found, err := ix.FindByTitle(book.Name, book.Authors)
+		return !found || id == book.ID, err
 	}
 
-	file, err := os.Open(FILENAME)
-	if err != nil {
-		return false, fmt.Errorf("ошибка открытия файла: %v", err)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-
-		existingBook, err := lineToDict(line)
-		if err != nil {
-			return false, fmt.Errorf("ошибка парсинга строки: %v", err)
-		}
-
-		if existingBook["name"] == book.Name && existingBook["authors"] == book.Authors {
-			return false, nil
+	unique := true
+	err := store.Scan(func(existing Book) bool {
+		if existing.ID != book.ID && existing.Name == book.Name && existing.Authors == book.Authors {
+			unique = false
+			return false
 		}
+		return true
+	})
+	if err != nil {
+		return false, err
 	}
+	return unique, nil
+}
 
-	if err := scanner.Err(); err != nil {
-		return false, fmt.Errorf("ошибка чтения файла: %v", err)
-	}
-
-	return true, nil
+type Book struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Authors string `json:"authors"`
+	Genres  string `json:"genres"`
+	Year    string `json:"year"`
+	Width   string `json:"width"`
+	Height  string `json:"height"`
+	Cover   string `json:"cover"`
+	Source  string `json:"source"`
+	Added   string `json:"added"`
+	Read    string `json:"read"`
+	Score   string `json:"score"`
+	Review  string `json:"review"`
 }
 
-func appendBookToFile(book Book) error {
+// bookFields lists the external field names in file column order
+var bookFields = []string{"id", "name", "year", "authors", "genres",
+	"width", "height", "cover", "source",
+	"added", "read", "score", "review"}
 
-	file, err := os.OpenFile(FILENAME, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("ошибка открытия файла: %v", err)
-	}
-	defer file.Close()
+// editableFields lists the fields in the order the create and update dialogues ask for them
+var editableFields = []string{"name", "authors", "genres", "year", "width", "height",
+	"cover", "source", "added", "read", "score", "review"}
 
-	line := fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s\n",
-		book.ID,
-		book.Name,
-		book.Year,
-		book.Authors,
-		book.Genres,
-		book.Width,
-		book.Height,
-		book.Cover,
-		book.Source,
-		book.Added,
-		book.Read,
-		book.Rating,
-	)
+var (
+	errBookExists   = errors.New("книга уже существует")
+	errBookNotFound = errors.New("книга не найдена")
+)
 
-	if _, err := file.WriteString(line); err != nil {
-		return fmt.Errorf("ошибка записи в файл: %v", err)
-	}
+// FieldError describes a validation failure of a single book field
+type FieldError struct {
+	Field string
+	Err   error
+}
 
-	return nil
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Field, e.Err)
 }
 
-const port = ":5000"
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
 
-type Book struct {
-	ID      string
-	Name    string
-	Authors string
-	Genres  string
-	Year    string
-	Width   string
-	Height  string
-	Cover   string
-	Source  string
-	Added   string
-	Read    string
-	Rating  string
+// validateBook runs every field of the book through setField in the same
+// order the interactive create dialogue asks for them
+func validateBook(book Book) (Book, error) {
+	validated := Book{ID: book.ID}
+	for _, field := range editableFields {
+		if err := validated.setField(field, strings.TrimSpace(book.getField(field))); err != nil {
+			return book, &FieldError{Field: field, Err: err}
+		}
+	}
+	return validated, nil
 }
 
-func displayMenu() string {
-	return `
+// displayMenu lists the main menu actions the role is allowed to use
+func displayMenu(r role) string {
+	var builder strings.Builder
+	builder.WriteString(`
  -------------------
 | Выберите действие |
  -------------------
 0 - Меню
-1 - Create
-2 - Read
-3 - Search
-4 - Delete
-5 - Update
-exit - Выйти
-`
+`)
+	for _, item := range mainMenu {
+		if r.allows(item.Role) {
+			builder.WriteString(item.Key + " - " + item.Title + "\n")
+		}
+	}
+	builder.WriteString("exit - Выйти\n")
+	return builder.String()
 }
 
 func displayCreateMenu() string {
@@ -320,158 +338,69 @@ const (
 	tempFilename = "temp_books.txt"
 )
 
-func lineToDict(line string) (map[string]string, error) {
-	parts := strings.Split(strings.TrimSpace(line), "|")
-
-	if len(parts) < 12 {
-		return nil, fmt.Errorf("недостаточно частей в строке (ожидается 12, получено %d)", len(parts))
-	}
-
-	return map[string]string{
-		"id":         parts[0],
-		"name":       parts[1],
-		"year":       parts[2],
-		"authors":    parts[3],
-		"genres":     parts[4],
-		"width":      parts[5],
-		"height":     parts[6],
-		"book_type":  parts[7],
-		"source":     parts[8],
-		"date_added": parts[9],
-		"date_read":  parts[10],
-		"rating":     parts[11],
-	}, nil
-}
-func getNextID() (int, error) {
-
-	// если файл существует
-	if _, err := os.Stat(FILENAME); os.IsNotExist(err) {
-		return 1, nil
-	}
-
-	// открыть
-	file, err := os.Open(FILENAME)
+// createBook assigns the next ID from the store sequence to the book and stores
+// it; client is recorded in the book history
+func createBook(book Book, client string) (Book, error) {
+	unlock, err := lockDB(true)
 	if err != nil {
-		return 0, fmt.Errorf("ошибка открытия файла: %v", err)
-	}
-	defer file.Close()
-
-	// найти последнюю строку
-	scanner := bufio.NewScanner(file)
-	var lastLine string
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" {
-			lastLine = line
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return 0, fmt.Errorf("ошибка чтения файла: %v", err)
+		return book, err
 	}
+	defer unlock()
 
-	// если пустой
-	if lastLine == "" {
-		return 1, nil
-	}
-
-	// парсим последнюю
-	book, err := lineToDict(lastLine)
-	if err != nil {
-		return 0, fmt.Errorf("ошибка парсинга строки: %v", err)
+	// Искусственная задержка для демонстрации блокировки
+	if createDelay > 0 {
+		time.Sleep(createDelay)
 	}
 
-	// if = int
-	id, err := strconv.Atoi(book["id"])
-	if err != nil {
-		return 0, fmt.Errorf("неверный формат ID: %v", err)
+	// Проверка на уникальность до выдачи ID, чтобы не тратить номера;
+	// переданный клиентом ID не используется
+	book.ID = ""
+	if isUnique, err := isUniqueBook(book); err != nil {
+		log.Printf("Ошибка проверки уникальности: %v", err)
+		return book, fmt.Errorf("ошибка проверки уникальности: %v", err)
+	} else if !isUnique {
+		log.Printf("Книга уже существует: %s, %s", book.Name, book.Authors)
+		return book, errBookExists
 	}
 
-	return id + 1, nil
-}
-
-func Create(book Book) string {
-	token <- struct{}{}
-	// Искусственная задержка для демонстрации блокировки
-	time.Sleep(3 * time.Second)
-
-	// Гарантируем освобождение токена при завершении
-	defer func() { <-token }()
-
 	// следующий ID
-	bookID, err := getNextID()
-
+	bookID, err := store.NextID()
 	if err != nil {
 		log.Printf("Ошибка получения ID: %v", err)
-		return fmt.Sprintf("Ошибка при получении ID: %v", err)
+		return book, fmt.Errorf("ошибка при получении ID: %v", err)
 	}
 	book.ID = strconv.Itoa(bookID)
 	log.Printf("Попытка создания книги ID %s", book.ID)
-	// Проверка на уникальность
-	if isUnique, err := isUniqueBook(book); err != nil {
-		log.Printf("Ошибка проверки уникальности: %v", err)
-		return fmt.Sprintf("Ошибка проверки уникальности: %v", err)
-	} else if !isUnique {
-		log.Printf("Книга уже существует: %s, %s", book.Name, book.Authors)
-		return fmt.Sprintf("Книга уже добавлена: %s, написанная %s", book.Name, book.Authors)
-	}
 
-	// Добавить в файл
-	if err := appendBookToFile(book); err != nil {
+	// Добавить в хранилище
+	if err := store.Insert(book); err != nil {
 		log.Printf("Ошибка записи книги: %v", err)
-		return fmt.Sprintf("Ошибка при записи в файл: %v", err)
+		return book, err
 	}
 
-	log.Printf("Книга успешно создана: %s (ID: %d)", book.Name, bookID)
-	return fmt.Sprintf("Добавлена книга: %s (ID: %d)", book.Name, bookID)
+	recordChange(historyCreate, nil, &book, client)
+	log.Printf("Книга успешно создана: %s (ID: %d) клиентом %s", book.Name, bookID, client)
+	return book, nil
 }
 
-func Read() ([]Book, error) {
-	if _, err := os.Stat(FILENAME); os.IsNotExist(err) {
-		return nil, nil // Файла нет - возвращаем пустой список
+func Create(book Book, client string) string {
+	created, err := createBook(book, client)
+	if errors.Is(err, errBookExists) {
+		return fmt.Sprintf("Книга уже добавлена: %s, написанная %s", book.Name, book.Authors)
 	}
-
-	file, err := os.Open(FILENAME)
 	if err != nil {
-		return nil, fmt.Errorf("ошибка открытия файла: %v", err)
-	}
-	defer file.Close()
-
-	var books []Book
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-
-		bookMap, err := lineToDict(line)
-		if err != nil {
-			return nil, fmt.Errorf("ошибка парсинга строки: %v", err)
-		}
-
-		book := Book{
-			ID:      bookMap["id"],
-			Name:    bookMap["name"],
-			Year:    bookMap["year"],
-			Authors: bookMap["authors"],
-			Genres:  bookMap["genres"],
-			Width:   bookMap["width"],
-			Height:  bookMap["height"],
-			Cover:   bookMap["book_type"],
-			Source:  bookMap["source"],
-			Added:   bookMap["date_added"],
-			Read:    bookMap["date_read"],
-			Rating:  bookMap["rating"],
-		}
-		books = append(books, book)
+		return "Ошибка: " + err.Error()
 	}
+	return fmt.Sprintf("Добавлена книга: %s (ID: %s)", created.Name, created.ID)
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("ошибка чтения файла: %v", err)
+func Read() ([]Book, error) {
+	unlock, err := lockDB(false)
+	if err != nil {
+		return nil, err
 	}
-
-	return books, nil
+	defer unlock()
+	return store.List()
 }
 
 func formatBookList(books []Book) string {
@@ -480,6 +409,24 @@ func formatBookList(books []Book) string {
 	}
 
 	var builder strings.Builder
+	writeBooks(&builder, books)
+	builder.WriteString(fmt.Sprintf("Всего книг: %d\n", len(books)))
+	return builder.String()
+
+}
+
+// formatBookPage renders one page of a longer list
+func formatBookPage(books []Book, info pageInfo) string {
+	var builder strings.Builder
+	writeBooks(&builder, books)
+	builder.WriteString(fmt.Sprintf("Страница %d из %d, всего книг: %d\n", info.Page, info.Pages, info.Total))
+	if info.Pages > 1 {
+		builder.WriteString("'>' - следующая страница, '<' - предыдущая, 'p' - перейти к странице\n")
+	}
+	return builder.String()
+}
+
+func writeBooks(builder *strings.Builder, books []Book) {
 	builder.WriteString("\nСписок книг:\n")
 	builder.WriteString(strings.Repeat("-", 50) + "\n")
 
@@ -487,17 +434,14 @@ func formatBookList(books []Book) string {
 		builder.WriteString(fmt.Sprintf(
 			"ID: %s\nНазвание: %s\nАвторы: %s\nГод: %s\nЖанры: %s\n"+
 				"Размер: %sx%s мм\nТип обложки: %s\nИсточник: %s\n"+
-				"Добавлена: %s\nПрочитана: %s\nРейтинг: %s\n"+
+				"Добавлена: %s\nПрочитана: %s\nОценка: %s\nОтзыв: %s\n"+
 				strings.Repeat("-", 50)+"\n",
 			book.ID, book.Name, book.Authors, book.Year, book.Genres,
 			book.Width, book.Height, book.Cover, book.Source,
-			book.Added, book.Read, book.Rating))
+			book.Added, book.Read, book.Score, book.Review))
 	}
-
-	builder.WriteString(fmt.Sprintf("Всего книг: %d\n", len(books)))
-	return builder.String()
-
 }
+
 func displayReadMenu() string {
 	return `
  ---------------
@@ -506,6 +450,11 @@ func displayReadMenu() string {
 2/
 |---- 0 - Меню
 |---- 1 - Вывести книги
+|---- s - Сортировка
+|---- > - Следующая страница
+|---- < - Предыдущая страница
+|---- p - Перейти к странице
+|---- n - Книг на странице
 |---- exit -  Назад
 `
 }
@@ -517,6 +466,11 @@ func displaySearchMenu() string {
 3/
 |---- 0 - Меню
 |---- 1 - Найти книги
+|---- s - Сортировка
+|---- > - Следующая страница
+|---- < - Предыдущая страница
+|---- p - Перейти к странице
+|---- n - Книг на странице
 |---- exit -  Назад
 `
 }
@@ -538,7 +492,15 @@ func displayFilterMenu() string {
 |---- ---- 9 - По полю 'source'
 |---- ---- 10 - По полю 'added'
 |---- ---- 11 - По полю 'read'
-|---- ---- 12 - По полю 'rating'
+|---- ---- 12 - По полю 'score'
+|---- ---- 13 - По полю 'review'
+|---- ---- 14 - Запрос (например: genres ~ Фантастика AND score >= 8 AND read = "")
+|---- ---- 15 - Диапазон по 'id', 'year', 'width', 'height', 'score', 'added' или 'read'
+|---- ---- s - Сортировка
+|---- ---- > - Следующая страница
+|---- ---- < - Предыдущая страница
+|---- ---- p - Перейти к странице
+|---- ---- n - Книг на странице
 |---- ---- exit -  Назад
 `
 }
@@ -568,8 +530,10 @@ func (b *Book) getField(field string) string {
 		return b.Added
 	case "read":
 		return b.Read
-	case "rating":
-		return b.Rating
+	case "score":
+		return b.Score
+	case "review":
+		return b.Review
 	default:
 		return ""
 	}
@@ -637,184 +601,155 @@ func (b *Book) setField(field string, value string) error {
 			}
 		}
 		b.Read = value
-	case "rating":
-		if value != "" {
-			if err := ValidateRating(value); err != nil {
-				return err
-			}
+	case "score":
+		if err := ValidateScore(value); err != nil {
+			return err
 		}
-		b.Rating = value
+		b.Score = value
+	case "review":
+		if err := ValidateReview(value); err != nil {
+			return err
+		}
+		b.Review = value
 	default:
 		return fmt.Errorf("неизвестное поле: %s", field)
 	}
 	return nil
 }
 
-// modifyBooksFile updates or deletes books in the file atomically
-func modifyBooksFile(books []Book, update bool) string {
-	token <- struct{}{}
-	defer func() { <-token }()
-	found := false
-	var result strings.Builder
-
-	// Create a map of books to update/delete for quick lookup
-	bookMap := make(map[string]Book)
-	for _, book := range books {
-		bookMap[book.ID] = book
-	}
-
-	// Open original file and temporary file
-	originalFile, err := os.Open(FILENAME)
-	if err != nil {
-		return fmt.Sprintf("Ошибка открытия файла: %v", err)
+// modifyBooks updates books in storage or moves them to the trash on behalf
+// of client, and returns the affected records as they were written (update)
+// or removed (delete)
+func modifyBooks(books []Book, update bool, client string) ([]Book, error) {
+	if !update {
+		var ids []string
+		for _, book := range books {
+			ids = append(ids, book.ID)
+		}
+		return deleteBooks(ids, client)
 	}
-	defer originalFile.Close()
 
-	tempFile, err := os.Create(tempFilename)
+	unlock, err := lockDB(true)
 	if err != nil {
-		return fmt.Sprintf("Ошибка создания временного файла: %v", err)
+		return nil, err
 	}
-	defer tempFile.Close()
+	defer unlock()
 
-	scanner := bufio.NewScanner(originalFile)
-	for scanner.Scan() {
-		line := scanner.Text()
-		bookData, err := lineToDict(line)
-		if err != nil {
-			return fmt.Sprintf("Ошибка парсинга строки: %v", err)
+	var affected []Book
+	for _, book := range books {
+		err := replaceBook(book, client)
+		if errors.Is(err, errBookNotFound) {
+			continue
 		}
-
-		bookID := bookData["id"]
-		if bookToModify, exists := bookMap[bookID]; exists {
-			found = true
-			if update {
-				// Update the book
-				newLine := fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s",
-					bookToModify.ID,
-					bookToModify.Name,
-					bookToModify.Year,
-					bookToModify.Authors,
-					bookToModify.Genres,
-					bookToModify.Width,
-					bookToModify.Height,
-					bookToModify.Cover,
-					bookToModify.Source,
-					bookToModify.Added,
-					bookToModify.Read,
-					bookToModify.Rating)
-
-				if _, err := tempFile.WriteString(newLine + "\n"); err != nil {
-					return fmt.Sprintf("Ошибка записи во временный файл: %v", err)
-				}
-				result.WriteString(fmt.Sprintf("Обновлена книга: %s (ID: %s)\n", bookToModify.Name, bookToModify.ID))
-			}
-			// For delete, we just skip writing this line
-			if !update {
-				result.WriteString(fmt.Sprintf("Удалена книга: %s (ID: %s)\n", bookData["name"], bookID))
-			}
-		} else {
-			// Write the original line for books not being modified
-			if _, err := tempFile.WriteString(line + "\n"); err != nil {
-				return fmt.Sprintf("Ошибка записи во временный файл: %v", err)
-			}
+		if err != nil {
+			return affected, err
 		}
+		affected = append(affected, book)
 	}
-
-	if err := scanner.Err(); err != nil {
-		return fmt.Sprintf("Ошибка чтения файла: %v", err)
+	if len(affected) == 0 {
+		return nil, errBookNotFound
 	}
+	return affected, nil
+}
 
-	if !found {
-		os.Remove(tempFilename)
+// modifyBooksFile updates or deletes books in the file atomically
+func modifyBooksFile(books []Book, update bool, client string) string {
+	affected, err := modifyBooks(books, update, client)
+	if errors.Is(err, errBookNotFound) {
 		return "Книги не найдены для изменения"
 	}
-
-	// Replace the original file with the temp file
-	originalFile.Close()
-	if err := os.Remove(FILENAME); err != nil {
-		return fmt.Sprintf("Ошибка удаления оригинального файла: %v", err)
-	}
-	if err := os.Rename(tempFilename, FILENAME); err != nil {
-		return fmt.Sprintf("Ошибка переименования временного файла: %v", err)
+	if err != nil {
+		return "Ошибка: " + err.Error()
 	}
 
+	var result strings.Builder
+	for _, book := range affected {
+		if update {
+			result.WriteString(fmt.Sprintf("Обновлена книга: %s (ID: %s)\n", book.Name, book.ID))
+		} else {
+			result.WriteString(fmt.Sprintf("Перемещена в корзину: %s (ID: %s)\n", book.Name, book.ID))
+		}
+	}
 	return result.String()
 }
 
-func searchBooks(field, value string) ([]Book, error) {
-	var results []Book
-
-	// Check if file exists
-	if _, err := os.Stat(FILENAME); os.IsNotExist(err) {
-		return results, nil
+// checkSearchValue checks a value to search a numeric field for by the rule
+// of that field, so a search that can't match anything is refused
+func checkSearchValue(field, value string) error {
+	switch field {
+	case "id", "year":
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("должно быть целое число")
+		}
+	case "width", "height":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("должно быть число, например 120 или 120.5")
+		}
+	case "score":
+		return ValidateScore(value) // пустая оценка находит книги без оценки
 	}
+	return nil
+}
+
+// searchBooks finds the books whose field contains value, ignoring case;
+// numeric fields have to be equal
+func searchBooks(field, value string) ([]Book, error) {
+	return findBooks(field, value, false)
+}
 
-	file, err := os.Open(FILENAME)
+// findBooks is searchBooks that, with exact, wants the whole value instead of
+// a substring: one of the authors or genres, or the entire text of another field
+func findBooks(field, value string, exact bool) ([]Book, error) {
+	unlock, err := lockDB(false)
 	if err != nil {
-		return nil, fmt.Errorf("ошибка открытия файла: %v", err)
+		return nil, err
 	}
-	defer file.Close()
+	defer unlock()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
+	if field == "id" {
+		book, err := store.Get(value)
+		if errors.Is(err, errBookNotFound) {
+			return nil, nil
 		}
-
-		bookMap, err := lineToDict(line)
 		if err != nil {
-			return nil, fmt.Errorf("ошибка парсинга строки: %v", err)
-		}
-
-		// Сопоставление внешних имен полей с внутренними
-		internalField := field
-		if field == "cover" {
-			internalField = "book_type"
-		}
-
-		valueBook, exists := bookMap[internalField]
-		if !exists {
-			continue
+			return nil, err
 		}
+		return []Book{book}, nil
+	}
 
-		book := Book{
-			ID:      bookMap["id"],
-			Name:    bookMap["name"],
-			Year:    bookMap["year"],
-			Authors: bookMap["authors"],
-			Genres:  bookMap["genres"],
-			Width:   bookMap["width"],
-			Height:  bookMap["height"],
-			Cover:   bookMap["book_type"],
-			Source:  bookMap["source"],
-			Added:   bookMap["date_added"],
-			Read:    bookMap["date_read"],
-			Rating:  bookMap["rating"],
-		}
-
-		if field == "id" {
-			if valueBook == value {
-				return []Book{book}, nil
-			}
-		} else if contains([]string{"year", "width", "height"}, field) {
-			if valueBook == value {
-				results = append(results, book)
-			}
-		} else {
-			if strings.Contains(strings.ToLower(valueBook), strings.ToLower(value)) {
-				results = append(results, book)
-			}
+	if ix, ok := store.(indexed); ok {
+		books, ok, err := ix.Lookup(field, value, exact)
+		if ok || err != nil {
+			return books, err
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("ошибка чтения файла: %v", err)
+	var results []Book
+	err = store.Scan(func(book Book) bool {
+		if fieldMatches(book.getField(field), field, value, exact) {
+			results = append(results, book)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return results, nil
 }
 
+func fieldMatches(valueBook, field, value string, exact bool) bool {
+	switch {
+	case contains([]string{"year", "width", "height", "score"}, field):
+		return valueBook == value
+	case exact && (field == "authors" || field == "genres"):
+		return contains(indexKeys(valueBook), strings.ToLower(strings.TrimSpace(value)))
+	case exact:
+		return strings.EqualFold(valueBook, value)
+	}
+	return strings.Contains(strings.ToLower(valueBook), strings.ToLower(value))
+}
+
 func contains(slice []string, item string) bool {
 	for _, s := range slice {
 		if s == item {
@@ -835,6 +770,20 @@ func displayUpdateMenu() string {
 `
 }
 
+func displayHistoryMenu() string {
+	return `
+ ---------------------
+| История изменений |
+ ---------------------
+7/
+|---- 0 - Меню
+|---- 1 - История книги
+|---- 2 - Сравнить версии
+|---- 3 - Откатить к версии
+|---- exit -  Назад
+`
+}
+
 func displayDeleteMenu() string {
 	return `
 ---------------
@@ -843,6 +792,10 @@ func displayDeleteMenu() string {
 4/
 |---- 0 - Меню
 |---- 1 - Удалить книги
+|---- 2 - Показать корзину
+|---- 3 - Восстановить из корзины
+|---- 4 - Удалить из корзины навсегда
+|---- 5 - Очистить корзину
 |---- exit -  Назад
 `
 }
@@ -875,112 +828,202 @@ func Delete(bookIDs []string) string {
 	for _, book := range booksToDelete {
 		builder.WriteString(fmt.Sprintf("ID: %s, Название: %s, Авторы: %s\n", book.ID, book.Name, book.Authors))
 	}
-	builder.WriteString("Подтвердите удаление (д/н):")
+	builder.WriteString("Книги будут перемещены в корзину. Подтвердите удаление (д/н):")
 
 	return builder.String()
 }
 
-func Update(book Book) string {
-	token <- struct{}{}        // Отправляем значение в канал (захватываем токен)
-	defer func() { <-token }() // Освобождаем токен при завершении
-	// Read all books
-	books, err := Read()
+// updateBook replaces the stored record that has the same ID as book
+func updateBook(book Book, client string) error {
+	unlock, err := lockDB(true)
 	if err != nil {
-		return fmt.Sprintf("Ошибка при чтении книг: %v", err)
+		return err
 	}
+	defer unlock()
+	return replaceBook(book, client)
+}
 
-	// Find the book to update
-	var found bool
-	for i, b := range books {
-		if b.ID == book.ID {
-			books[i] = book
-			found = true
-			break
-		}
+// checkReplacement checks a changed book before it overwrites the stored
+// one: all fields together, like validateBook, so a new year can't be later
+// than the date the book was added, and that no other book has the same name
+// and authors. The caller holds the exclusive lock
+func checkReplacement(book Book) error {
+	if _, err := validateBook(book); err != nil {
+		return err
 	}
-
-	if !found {
-		return fmt.Sprintf("Книга с ID %s не найдена", book.ID)
+	unique, err := isUniqueBook(book)
+	if err != nil {
+		return fmt.Errorf("ошибка проверки уникальности: %v", err)
 	}
+	if !unique {
+		return errBookExists
+	}
+	return nil
+}
 
-	// Write all books back to file
-	tempFilename := "temp_books.txt"
-	tempFile, err := os.Create(tempFilename)
+// replaceBook stores book over the record with the same ID and records the
+// change. The caller holds the exclusive lock
+func replaceBook(book Book, client string) error {
+	before, err := store.Get(book.ID)
 	if err != nil {
-		return fmt.Sprintf("Ошибка создания временного файла: %v", err)
+		return err
 	}
-	defer tempFile.Close()
-
-	for _, book := range books {
-		line := fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s\n",
-			book.ID,
-			book.Name,
-			book.Year,
-			book.Authors,
-			book.Genres,
-			book.Width,
-			book.Height,
-			book.Cover,
-			book.Source,
-			book.Added,
-			book.Read,
-			book.Rating,
-		)
-		if _, err := tempFile.WriteString(line); err != nil {
-			return fmt.Sprintf("Ошибка записи во временный файл: %v", err)
-		}
+	if err := checkReplacement(book); err != nil {
+		return err
 	}
+	if err := store.Replace(book); err != nil {
+		return err
+	}
+	recordChange(historyUpdate, &before, &book, client)
+	log.Printf("Книга %s (ID: %s) обновлена клиентом %s", book.Name, book.ID, client)
+	return nil
+}
 
-	// Replace the original file
-	if err := os.Remove(FILENAME); err != nil {
-		return fmt.Sprintf("Ошибка удаления оригинального файла: %v", err)
+func Update(book Book, client string) string {
+	err := updateBook(book, client)
+	if errors.Is(err, errBookNotFound) {
+		return fmt.Sprintf("Книга с ID %s не найдена", book.ID)
 	}
-	if err := os.Rename(tempFilename, FILENAME); err != nil {
-		return fmt.Sprintf("Ошибка переименования временного файла: %v", err)
+	if errors.Is(err, errBookExists) {
+		return fmt.Sprintf("Книга уже добавлена: %s, написанная %s", book.Name, book.Authors)
+	}
+	if err != nil {
+		return "Ошибка: " + err.Error()
 	}
-
 	return fmt.Sprintf("Книга с ID %s успешно обновлена", book.ID)
 }
 
 func handleClient(conn net.Conn) {
+	if err := sessions.add(conn); err != nil {
+		reject(conn, err)
+		return
+	}
 	defer conn.Close()
+	defer sessions.done(conn)
 	remoteAddr := conn.RemoteAddr().String()
-	log.Printf("Новое соединение: %s", remoteAddr)
+	sessions.extendDeadline(conn)
+	if peer, err := peerName(conn); err != nil {
+		log.Printf("%s: %v", remoteAddr, err)
+		return
+	} else if peer != "" {
+		log.Printf("%s предъявил сертификат %s", remoteAddr, peer)
+	}
 
 	writer := bufio.NewWriter(conn)
-	scanner := bufio.NewScanner(conn)
+	scanner := bufio.NewScanner(idleReader{conn})
 
 	sendMessage := func(msg string) {
 		writer.WriteString(msg + "\n")
 		writer.Flush()
 	}
 
+	// Последний выведенный список, по которому листают страницы
+	pages := newPager()
+	pageCommand := func(command string) {
+		switch command {
+		case ">":
+			sendMessage(pages.next())
+		case "<":
+			sendMessage(pages.prev())
+		case "s":
+			sendMessage("Введите поле для сортировки (например: year, -year - по убыванию, пусто - порядок файла):")
+			if !scanner.Scan() {
+				return
+			}
+			if err := pages.setSort(scanner.Text()); err != nil {
+				sendMessage("Ошибка: " + err.Error())
+			} else if pages.books != nil {
+				sendMessage(pages.render())
+			} else {
+				sendMessage("Сортировка установлена")
+			}
+		case "n":
+			sendMessage("Введите число книг на странице:")
+			if !scanner.Scan() {
+				return
+			}
+			if err := pages.setSize(scanner.Text()); err != nil {
+				sendMessage("Ошибка: " + err.Error())
+			} else if pages.books != nil {
+				sendMessage(pages.render())
+			} else {
+				sendMessage("Размер страницы установлен")
+			}
+		case "p":
+			sendMessage("Введите номер страницы:")
+			if !scanner.Scan() {
+				return
+			}
+			sendMessage(pages.goTo(scanner.Text()))
+		}
+	}
+
 	// Отправляем приветствие
 	sendMessage("Вы подключились к серверу!")
-	sendMessage(displayMenu())
+
+	// Действия записываются в журнал и историю под именем пользователя,
+	// а без учетных записей - под адресом клиента
+	client := remoteAddr
+	userRole := anonymousRole
+	required, err := authRequired()
+	if err != nil {
+		log.Printf("Ошибка чтения пользователей: %v", err)
+		sendMessage("Ошибка сервера, попробуйте позже")
+		return
+	}
+	if required {
+		acc, err := login(scanner, sendMessage)
+		if err != nil {
+			log.Printf("%s не вошел: %v", remoteAddr, err)
+			sendMessage("Вход не выполнен")
+			return
+		}
+		client, userRole = acc.Name, acc.Role
+		log.Printf("%s вошел как %s (%s)", remoteAddr, client, userRole)
+		sendMessage("Добро пожаловать, " + client + "!")
+	}
+
+	// permitted checks the role before an action and tells the client if it is refused
+	permitted := func(required role, action string) bool {
+		if userRole.allows(required) {
+			return true
+		}
+		log.Printf("%s (%s): отказано в действии %s", client, userRole, action)
+		sendMessage("Недостаточно прав для этого действия")
+		return false
+	}
+	sendMessage(displayMenu(userRole))
 
 	for scanner.Scan() {
 		text := strings.TrimSpace(scanner.Text())
-		log.Printf("%s прислал: %s", remoteAddr, text)
+		log.Printf("%s прислал: %s", client, text)
+		if text == jsonHandshake {
+			log.Printf("%s переключился в режим JSON", client)
+			serveJSON(scanner, sendMessage, client, userRole)
+			return
+		}
 		sendMessage("Вы выбрали действие: " + text)
+		if !permitted(menuRole(text), text) {
+			continue
+		}
 
 		switch text {
 		case "exit":
 			sendMessage("До свидания!")
-			log.Printf("Соединение с %s закрыто по команде exit", remoteAddr)
+			log.Printf("Соединение с %s закрыто по команде exit", client)
 			return
 		case "0":
-			sendMessage(displayMenu())
+			sendMessage(displayMenu(userRole))
 		case "1":
 			sendMessage(displayCreateMenu())
 		createLoop:
 			for scanner.Scan() {
 				subText := strings.TrimSpace(scanner.Text())
-				log.Printf("%s прислал: %s", remoteAddr, subText)
+				log.Printf("%s прислал: %s", client, subText)
 				switch subText {
 				case "exit":
 					sendMessage("Возврат в главное меню")
-					sendMessage(displayMenu())
+					sendMessage(displayMenu(userRole))
 					break createLoop
 				case "0":
 					sendMessage(displayCreateMenu())
@@ -992,7 +1035,7 @@ func handleClient(conn net.Conn) {
 					sendMessage("Введите название книги:")
 					for scanner.Scan() {
 						input = strings.TrimSpace(scanner.Text())
-						log.Printf("%s прислал: %s", remoteAddr, input)
+						log.Printf("%s прислал: %s", client, input)
 						if err = ValidateName(input); err == nil {
 							book.Name = input
 							break
@@ -1005,7 +1048,7 @@ func handleClient(conn net.Conn) {
 					sendMessage("Введите авторов (через запятую):")
 					for scanner.Scan() {
 						input = strings.TrimSpace(scanner.Text())
-						log.Printf("%s прислал: %s", remoteAddr, input)
+						log.Printf("%s прислал: %s", client, input)
 						normalized, err := ValidateAuthors(input)
 						if err == nil {
 							book.Authors = normalized
@@ -1019,7 +1062,7 @@ func handleClient(conn net.Conn) {
 					sendMessage("Введите жанры (через запятую):")
 					for scanner.Scan() {
 						input = strings.TrimSpace(scanner.Text())
-						log.Printf("%s прислал: %s", remoteAddr, input)
+						log.Printf("%s прислал: %s", client, input)
 						normalized, err := ValidateGenres(input)
 						if err == nil {
 							book.Genres = normalized
@@ -1033,7 +1076,7 @@ func handleClient(conn net.Conn) {
 					sendMessage("Введите год издания:")
 					for scanner.Scan() {
 						input = strings.TrimSpace(scanner.Text())
-						log.Printf("%s прислал: %s", remoteAddr, input)
+						log.Printf("%s прислал: %s", client, input)
 						if err = ValidateYear(input); err == nil {
 							book.Year = input
 							break
@@ -1046,7 +1089,7 @@ func handleClient(conn net.Conn) {
 					sendMessage("Введите ширину книги (мм):")
 					for scanner.Scan() {
 						input = strings.TrimSpace(scanner.Text())
-						log.Printf("%s прислал: %s", input)
+						log.Printf("%s прислал: %s", client, input)
 						if err = ValidateHeightWidth(input, "width"); err == nil {
 							book.Width = input
 							break
@@ -1059,7 +1102,7 @@ func handleClient(conn net.Conn) {
 					sendMessage("Введите высоту книги (мм):")
 					for scanner.Scan() {
 						input = strings.TrimSpace(scanner.Text())
-						log.Printf("%s прислал: %s", remoteAddr, input)
+						log.Printf("%s прислал: %s", client, input)
 						if err = ValidateHeightWidth(input, "height"); err == nil {
 							book.Height = input
 							break
@@ -1072,7 +1115,7 @@ func handleClient(conn net.Conn) {
 					sendMessage("Введите тип обложки (мягкий/твердый):")
 					for scanner.Scan() {
 						input = strings.TrimSpace(scanner.Text())
-						log.Printf("%s прислал: %s", remoteAddr, input)
+						log.Printf("%s прислал: %s", client, input)
 						if err = ValidateCover(input); err == nil {
 							book.Cover = input
 							break
@@ -1085,7 +1128,7 @@ func handleClient(conn net.Conn) {
 					sendMessage("Введите источник (покупка/подарок/наследство):")
 					for scanner.Scan() {
 						input = strings.TrimSpace(scanner.Text())
-						log.Printf("%s прислал: %s", remoteAddr, input)
+						log.Printf("%s прислал: %s", client, input)
 						if err = ValidateSource(input); err == nil {
 							book.Source = input
 							break
@@ -1098,7 +1141,7 @@ func handleClient(conn net.Conn) {
 					sendMessage("Введите дату добавления (ДД-ММ-ГГГГ):")
 					for scanner.Scan() {
 						input = strings.TrimSpace(scanner.Text())
-						log.Printf("%s прислал: %s", remoteAddr, input)
+						log.Printf("%s прислал: %s", client, input)
 						if err = ValidateAdded(input, book.Year); err == nil {
 							book.Added = input
 							break
@@ -1111,7 +1154,7 @@ func handleClient(conn net.Conn) {
 					sendMessage("Введите дату прочтения (ДД-ММ-ГГГГ) или оставьте пустым:")
 					for scanner.Scan() {
 						input = strings.TrimSpace(scanner.Text())
-						log.Printf("%s прислал: %s", remoteAddr, input)
+						log.Printf("%s прислал: %s", client, input)
 						if input == "" {
 							break
 						}
@@ -1124,21 +1167,38 @@ func handleClient(conn net.Conn) {
 						sendMessage("Введите дату прочтения (ДД-ММ-ГГГГ) или оставьте пустым:")
 					}
 
-					// Rating
-					sendMessage("Введите рейтинг (X/10 - комментарий) или оставьте пустым:")
+					// Score
+					sendMessage("Введите оценку от 1 до 10 или оставьте пустым:")
+					for scanner.Scan() {
+						input = strings.TrimSpace(scanner.Text())
+						log.Printf("%s прислал: %s", client, input)
+						if input == "" {
+							break
+						}
+
+						if err = ValidateScore(input); err == nil {
+							book.Score = input
+							break
+						}
+						sendMessage("Неверный ввод: " + err.Error())
+						sendMessage("Введите оценку от 1 до 10 или оставьте пустым:")
+					}
+
+					// Review
+					sendMessage("Введите отзыв или оставьте пустым:")
 					for scanner.Scan() {
 						input = strings.TrimSpace(scanner.Text())
-						log.Printf("%s прислал: %s", remoteAddr, input)
+						log.Printf("%s прислал: %s", client, input)
 						if input == "" {
 							break
 						}
 
-						if err = ValidateRating(input); err == nil {
-							book.Rating = input
+						if err = ValidateReview(input); err == nil {
+							book.Review = input
 							break
 						}
 						sendMessage("Неверный ввод: " + err.Error())
-						sendMessage("Введите рейтинг (X/10 - комментарий) или оставьте пустым:")
+						sendMessage("Введите отзыв или оставьте пустым:")
 					}
 
 					// Подтвердить добавление
@@ -1154,19 +1214,20 @@ ID: %s
 Источник: %s
 Дата добавления: %s
 Дата прочтения: %s
-Рейтинг: %s
+Оценка: %s
+Отзыв: %s
 `, book.ID, book.Name, book.Authors, book.Genres, book.Year, book.Width, book.Height,
-						book.Cover, book.Source, book.Added, book.Read, book.Rating))
+						book.Cover, book.Source, book.Added, book.Read, book.Score, book.Review))
 					sendMessage("Добавить книгу? (д/н):")
 					for scanner.Scan() {
 						confirm := strings.ToLower(strings.TrimSpace(scanner.Text()))
-						log.Printf("%s подтверждение: %s", remoteAddr, confirm)
+						log.Printf("%s подтверждение: %s", client, confirm)
 						if confirm == "д" || confirm == "y" {
 							sendMessage("Добавление книги... ")
-							log.Printf("Клиент %s начинает добавление книги", remoteAddr)
-							result := Create(book)
+							log.Printf("Клиент %s начинает добавление книги", client)
+							result := Create(book, client)
 							sendMessage(result)
-							log.Printf("Клиент %s завершил добавление книги", remoteAddr)
+							log.Printf("Клиент %s завершил добавление книги", client)
 							break
 						} else if confirm == "н" || confirm == "n" {
 							sendMessage("Добавление отменено. Отправьте '0' для просмотра меню")
@@ -1182,11 +1243,11 @@ ID: %s
 		readLoop:
 			for scanner.Scan() {
 				subText := strings.TrimSpace(scanner.Text())
-				log.Printf("%s прислал: %s", remoteAddr, subText)
+				log.Printf("%s прислал: %s", client, subText)
 				switch subText {
 				case "exit":
 					sendMessage("Возврат в главное меню")
-					sendMessage(displayMenu())
+					sendMessage(displayMenu(userRole))
 					break readLoop
 				case "0":
 					sendMessage(displayReadMenu())
@@ -1196,9 +1257,11 @@ ID: %s
 						sendMessage("Ошибка при чтении списка книг: " + err.Error())
 					} else {
 						sendMessage("Вывод всех книг...")
-						sendMessage(formatBookList(books))
+						sendMessage(pages.show(books))
 					}
 					sendMessage("Книги выведены. Отправьте '0' для просмотра меню")
+				case ">", "<", "s", "n", "p":
+					pageCommand(subText)
 				default:
 					sendMessage("Неверный выбор в подменю. Попробуйте снова.")
 				}
@@ -1208,14 +1271,16 @@ ID: %s
 		searchLoop:
 			for scanner.Scan() {
 				subText := strings.TrimSpace(scanner.Text())
-				log.Printf("%s прислал: %s", remoteAddr, subText)
+				log.Printf("%s прислал: %s", client, subText)
 				switch subText {
 				case "exit":
 					sendMessage("Возврат в главное меню")
-					sendMessage(displayMenu())
+					sendMessage(displayMenu(userRole))
 					break searchLoop
 				case "0":
 					sendMessage(displaySearchMenu())
+				case ">", "<", "s", "n", "p":
+					pageCommand(subText)
 				case "1":
 					// Search for books to update
 					sendMessage(displayFilterMenu())
@@ -1224,7 +1289,7 @@ ID: %s
 				filterLoop:
 					for scanner.Scan() {
 						input := strings.TrimSpace(scanner.Text())
-						log.Printf("%s прислал: %s", remoteAddr, input)
+						log.Printf("%s прислал: %s", client, input)
 						switch input {
 						case "exit":
 							sendMessage("Возврат в меню обновления")
@@ -1232,33 +1297,29 @@ ID: %s
 							break filterLoop
 						case "0":
 							sendMessage(displayFilterMenu())
-						case "1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12":
+						case ">", "<", "s", "n", "p":
+							pageCommand(input)
+						case "1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13":
 							choice, err := strconv.Atoi(input)
 							if err != nil {
 								sendMessage("Неверный номер поля")
 								continue
 							}
 
-							fields := []string{"id", "name", "year", "authors", "genres",
-								"width", "height", "cover", "source",
-								"added", "read", "rating"}
-
-							if choice < 1 || choice > len(fields) {
+							if choice < 1 || choice > len(bookFields) {
 								sendMessage("Неверный номер поля")
 								continue
 							}
 
-							field = fields[choice-1]
+							field = bookFields[choice-1]
 							sendMessage(fmt.Sprintf("Введите значение для поиска по полю '%s':", field))
 
 							// Get search value with validation
 							for scanner.Scan() {
 								value = strings.TrimSpace(scanner.Text())
-								if field == "id" || field == "width" || field == "height" {
-									if _, err := strconv.Atoi(value); err != nil {
-										sendMessage("Должно быть целое число. Попробуйте снова:")
-										continue
-									}
+								if err := checkSearchValue(field, value); err != nil {
+									sendMessage(fmt.Sprintf("Ошибка: %v. Попробуйте снова:", err))
+									continue
 								}
 								break
 							}
@@ -1276,7 +1337,75 @@ ID: %s
 							}
 
 							sendMessage("Найдены книги:")
-							sendMessage(formatBookList(books))
+							sendMessage(pages.show(books))
+
+						case "14":
+							sendMessage("Введите запрос: поле оператор значение (= != ~ ^ < <= > >=), условия через AND, OR, NOT и скобки:")
+							if !scanner.Scan() {
+								break filterLoop
+							}
+							input := strings.TrimSpace(scanner.Text())
+							log.Printf("%s прислал: %s", client, input)
+
+							query, err := ParseQuery(input)
+							if err != nil {
+								sendMessage("Ошибка в запросе: " + err.Error())
+								continue filterLoop
+							}
+
+							books, err := queryBooks(query)
+							if err != nil {
+								sendMessage(fmt.Sprintf("Ошибка поиска: %v", err))
+								continue filterLoop
+							}
+
+							if len(books) == 0 {
+								sendMessage("Книги не найдены")
+								continue filterLoop
+							}
+
+							sendMessage("Найдены книги:")
+							sendMessage(pages.show(books))
+
+						case "15":
+							sendMessage("Введите поле (id, year, width, height, score, added, read):")
+							if !scanner.Scan() {
+								break filterLoop
+							}
+							field := strings.ToLower(strings.TrimSpace(scanner.Text()))
+
+							var bounds rangeBounds
+							sendMessage("От (включительно; для дат ДД-ММ-ГГГГ, ММ-ГГГГ или ГГГГ), пусто - без ограничения:")
+							if !scanner.Scan() {
+								break filterLoop
+							}
+							bounds.Min = strings.TrimSpace(scanner.Text())
+							sendMessage("До (включительно), пусто - без ограничения:")
+							if !scanner.Scan() {
+								break filterLoop
+							}
+							bounds.Max = strings.TrimSpace(scanner.Text())
+							log.Printf("%s прислал диапазон: %s [%s; %s]", client, field, bounds.Min, bounds.Max)
+
+							query, err := RangeQuery(field, bounds)
+							if err != nil {
+								sendMessage("Ошибка в диапазоне: " + err.Error())
+								continue filterLoop
+							}
+
+							books, err := queryBooks(query)
+							if err != nil {
+								sendMessage(fmt.Sprintf("Ошибка поиска: %v", err))
+								continue filterLoop
+							}
+
+							if len(books) == 0 {
+								sendMessage("Книги не найдены")
+								continue filterLoop
+							}
+
+							sendMessage("Найдены книги:")
+							sendMessage(pages.show(books))
 
 						default:
 							sendMessage("Неверный выбор в подменю. Попробуйте снова.")
@@ -1291,11 +1420,11 @@ ID: %s
 		deleteLoop:
 			for scanner.Scan() {
 				subText := strings.TrimSpace(scanner.Text())
-				log.Printf("%s прислал: %s", remoteAddr, subText)
+				log.Printf("%s прислал: %s", client, subText)
 				switch subText {
 				case "exit":
 					sendMessage("Возврат в главное меню")
-					sendMessage(displayMenu())
+					sendMessage(displayMenu(userRole))
 					break deleteLoop
 				case "0":
 					sendMessage(displayDeleteMenu())
@@ -1330,12 +1459,66 @@ ID: %s
 							}
 						}
 
-						result := modifyBooksFile(booksToDelete, false)
+						result := modifyBooksFile(booksToDelete, false, client)
 						sendMessage(result)
 					} else {
 						sendMessage("Удаление отменено")
 					}
 					sendMessage("Отправьте '0' для просмотра меню")
+				case "2":
+					entries, err := listTrash()
+					if err != nil {
+						sendMessage(fmt.Sprintf("Ошибка чтения корзины: %v", err))
+						continue
+					}
+					sendMessage(formatTrash(entries))
+				case "3":
+					sendMessage("Введите ID книги для восстановления:")
+					if !scanner.Scan() {
+						break deleteLoop
+					}
+					id := strings.TrimSpace(scanner.Text())
+					book, err := restoreFromTrash(id, client)
+					switch {
+					case errors.Is(err, errBookExists):
+						sendMessage("Нельзя восстановить: книга с таким ID или названием и авторами уже есть")
+					case err != nil:
+						sendMessage("Ошибка: " + err.Error())
+					default:
+						sendMessage(fmt.Sprintf("Восстановлена книга: %s (ID: %s)", book.Name, book.ID))
+					}
+				case "4", "5":
+					var ids []string
+					if subText == "4" {
+						sendMessage("Введите ID книг для окончательного удаления (через запятую):")
+						if !scanner.Scan() {
+							break deleteLoop
+						}
+						for _, id := range strings.Split(scanner.Text(), ",") {
+							if id = strings.TrimSpace(id); id != "" {
+								ids = append(ids, id)
+							}
+						}
+						if len(ids) == 0 {
+							sendMessage("ID не указаны")
+							continue
+						}
+					}
+					sendMessage("Удалить навсегда? Восстановить будет нельзя (д/н):")
+					if !scanner.Scan() {
+						break deleteLoop
+					}
+					if confirm := strings.ToLower(strings.TrimSpace(scanner.Text())); confirm != "д" && confirm != "y" {
+						sendMessage("Удаление отменено")
+						continue
+					}
+					purged, err := purgeTrash(ids)
+					if err != nil {
+						sendMessage("Ошибка: " + err.Error())
+						continue
+					}
+					log.Printf("%s удалил из корзины навсегда книг: %d", client, len(purged))
+					sendMessage(fmt.Sprintf("Удалено навсегда книг: %d", len(purged)))
 				default:
 					sendMessage("Неверный выбор в подменю. Попробуйте снова.")
 				}
@@ -1346,11 +1529,11 @@ ID: %s
 		updateLoop:
 			for scanner.Scan() {
 				subText := strings.TrimSpace(scanner.Text())
-				log.Printf("%s прислал: %s", remoteAddr, subText)
+				log.Printf("%s прислал: %s", client, subText)
 				switch subText {
 				case "exit":
 					sendMessage("Возврат в главное меню")
-					sendMessage(displayMenu())
+					sendMessage(displayMenu(userRole))
 					break updateLoop
 				case "0":
 					sendMessage(displayUpdateMenu())
@@ -1404,7 +1587,8 @@ ID: %s
 							}
 							return ValidateRead(s, book.Added)
 						}},
-						{"rating", "Рейтинг (X/10 - комментарий) или пусто:", ValidateRating},
+						{"score", "Оценка от 1 до 10 или пусто:", ValidateScore},
+						{"review", "Отзыв или пусто:", ValidateReview},
 					}
 
 					for _, field := range fields {
@@ -1452,15 +1636,16 @@ ID: %s
 Источник: %s
 Дата добавления: %s
 Дата прочтения: %s
-Рейтинг: %s
+Оценка: %s
+Отзыв: %s
 `, book.ID, book.Name, book.Authors, book.Genres, book.Year, book.Width, book.Height,
-						book.Cover, book.Source, book.Added, book.Read, book.Rating))
+						book.Cover, book.Source, book.Added, book.Read, book.Score, book.Review))
 
 					sendMessage("Подтвердите обновление (д/н):")
 					scanner.Scan()
 					confirm := strings.ToLower(strings.TrimSpace(scanner.Text()))
 					if confirm == "д" || confirm == "y" {
-						result := Update(book)
+						result := Update(book, client)
 						sendMessage(result)
 					} else {
 						sendMessage("Обновление отменено")
@@ -1470,32 +1655,218 @@ ID: %s
 					sendMessage("Неверный выбор в подменю. Попробуйте снова.")
 				}
 			}
+		case "6": // Statistics
+			stats, err := libraryStatistics()
+			if err != nil {
+				sendMessage(fmt.Sprintf("Ошибка подсчета статистики: %v", err))
+				continue
+			}
+			sendMessage(formatStats(stats))
+			sendMessage("Отправьте '0' для просмотра меню")
+		case "7": // History
+			sendMessage(displayHistoryMenu())
+		historyLoop:
+			for scanner.Scan() {
+				subText := strings.TrimSpace(scanner.Text())
+				log.Printf("%s прислал: %s", client, subText)
+				switch subText {
+				case "exit":
+					sendMessage("Возврат в главное меню")
+					sendMessage(displayMenu(userRole))
+					break historyLoop
+				case "0":
+					sendMessage(displayHistoryMenu())
+				case "1", "2", "3":
+					sendMessage("Введите ID книги:")
+					if !scanner.Scan() {
+						break historyLoop
+					}
+					id := strings.TrimSpace(scanner.Text())
+
+					switch subText {
+					case "1":
+						entries, err := bookHistory(id)
+						if errors.Is(err, errBookNotFound) {
+							sendMessage(fmt.Sprintf("История книги с ID %s не найдена", id))
+						} else if err != nil {
+							sendMessage("Ошибка: " + err.Error())
+						} else {
+							sendMessage(formatHistory(entries))
+						}
+					case "2":
+						sendMessage("Введите две версии через пробел (0 - до создания книги):")
+						if !scanner.Scan() {
+							break historyLoop
+						}
+						parts := strings.Fields(scanner.Text())
+						if len(parts) != 2 {
+							sendMessage("Нужно ввести две версии")
+							continue
+						}
+						from, errFrom := strconv.Atoi(parts[0])
+						to, errTo := strconv.Atoi(parts[1])
+						if errFrom != nil || errTo != nil {
+							sendMessage("Версия должна быть числом")
+							continue
+						}
+						changes, err := diffVersions(id, from, to)
+						if err != nil {
+							sendMessage("Ошибка: " + err.Error())
+						} else {
+							sendMessage(formatDiff(changes))
+						}
+					case "3":
+						if !permitted(roleEditor, "revert") {
+							continue
+						}
+						sendMessage("Введите версию, к которой откатить книгу:")
+						if !scanner.Scan() {
+							break historyLoop
+						}
+						version, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+						if err != nil {
+							sendMessage("Версия должна быть числом")
+							continue
+						}
+						book, err := revertBook(id, version, client)
+						if errors.Is(err, errBookNotFound) {
+							sendMessage(fmt.Sprintf("Книга с ID %s не найдена, удаленную книгу сначала восстановите из корзины", id))
+						} else if err != nil {
+							sendMessage("Ошибка: " + err.Error())
+						} else {
+							sendMessage(fmt.Sprintf("Книга %s (ID: %s) возвращена к версии %d", book.Name, book.ID, version))
+						}
+					}
+					sendMessage("Отправьте '0' для просмотра меню")
+				default:
+					sendMessage("Неверный выбор в подменю. Попробуйте снова.")
+				}
+			}
 		}
-		if err := scanner.Err(); err != nil {
-			log.Printf("Ошибка чтения от %s: %v", remoteAddr, err)
-		}
-		log.Printf("Соединение с %s закрыто", remoteAddr)
 	}
+	if sessions.shuttingDown() {
+		sendMessage("Сервер завершает работу. До свидания!")
+	} else if isTimeout(scanner.Err()) {
+		log.Printf("Сеанс %s закрыт из-за бездействия", client)
+		sendMessage("Сеанс закрыт из-за бездействия")
+	} else if err := scanner.Err(); err != nil {
+		log.Printf("Ошибка чтения от %s: %v", client, err)
+	}
+	log.Printf("Соединение с %s закрыто", client)
+}
+
+// recoverStore lets the store repair itself before the first operation
+func recoverStore() error {
+	r, ok := store.(recoverable)
+	if !ok {
+		return nil
+	}
+	unlock, err := lockDB(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return r.Recover()
 }
 
 func main() {
-	listener, err := net.Listen("tcp", port)
+	defineFlags()
+	flag.Parse()
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Ошибка настроек: %v", err)
+	}
+	if printConfig {
+		if err := writeConfig(config); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	switch flag.Arg(0) {
+	case "fsck":
+		os.Exit(runFsck(flag.Args()[1:]))
+	case "import":
+		if err := recoverStore(); err != nil {
+			log.Fatalf("Ошибка восстановления хранилища: %v", err)
+		}
+		os.Exit(runImport(flag.Args()[1:]))
+	case "export":
+		if err := recoverStore(); err != nil {
+			log.Fatalf("Ошибка восстановления хранилища: %v", err)
+		}
+		os.Exit(runExport(flag.Args()[1:]))
+	case "dump":
+		if err := recoverStore(); err != nil {
+			log.Fatalf("Ошибка восстановления хранилища: %v", err)
+		}
+		os.Exit(runDump(flag.Args()[1:]))
+	case "restore":
+		if err := recoverStore(); err != nil {
+			log.Fatalf("Ошибка восстановления хранилища: %v", err)
+		}
+		os.Exit(runRestore(flag.Args()[1:]))
+	case "useradd":
+		os.Exit(runUserAdd(flag.Args()[1:]))
+	case "userdel":
+		os.Exit(runUserDel(flag.Args()[1:]))
+	case "usermod":
+		os.Exit(runUserMod(flag.Args()[1:]))
+	}
+
+	if err := recoverStore(); err != nil {
+		log.Fatalf("Ошибка восстановления хранилища: %v", err)
+	}
+
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	listener, err := listen(config.Listen, tlsConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer listener.Close()
-	log.Printf("Сервер слушает на %s", port)
-	if _, err := os.Open(FILENAME); err != nil {
-		os.Rename(tempFilename, FILENAME)
+	if tlsConfig != nil {
+		log.Printf("Сервер слушает на %s (TLS)", config.Listen)
+	} else {
+		log.Printf("Сервер слушает на %s", config.Listen)
+	}
+
+	if required, err := authRequired(); err != nil {
+		log.Fatal(err)
+	} else if !required {
+		log.Printf("ВНИМАНИЕ: учетных записей в %s нет, клиенты подключаются без входа с ролью %s и не могут менять базу. "+
+			"Добавьте администратора: crud_in_txt useradd -role admin имя", usersPath, anonymousRole)
+	}
+
+	var httpServer *http.Server
+	if config.HTTP {
+		httpServer = newHTTPServer(tlsConfig)
+		go serveHTTP(httpServer)
+	}
+	if trashRetention > 0 {
+		go purgeTrashPeriodically()
 	}
-	os.Remove(tempFilename)
+
+	// По сигналу перестаем принимать соединения, и цикл ниже завершается
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		log.Printf("Получен сигнал завершения, новые соединения не принимаются")
+		listener.Close()
+	}()
 
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
 		if err != nil {
 			log.Printf("Ошибка соединения: %v", err)
 			continue
 		}
 		go handleClient(conn)
 	}
+	shutdown(httpServer)
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+// memoryStore keeps books in a slice; nothing touches the file system
+type memoryStore struct {
+	mu     sync.RWMutex
+	books  []Book
+	lastID int
+}
+
+func newMemoryStore(books ...Book) *memoryStore {
+	s := &memoryStore{books: append([]Book(nil), books...)}
+	for _, book := range books {
+		s.seeID(book.ID)
+	}
+	return s
+}
+
+// seeID moves the sequence past id so it is never allocated again
+func (s *memoryStore) seeID(id string) {
+	if n, err := strconv.Atoi(id); err == nil && n > s.lastID {
+		s.lastID = n
+	}
+}
+
+func (s *memoryStore) NextID() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID++
+	return s.lastID, nil
+}
+
+func (s *memoryStore) Scan(fn func(Book) bool) error {
+	s.mu.RLock()
+	books := append([]Book(nil), s.books...)
+	s.mu.RUnlock()
+
+	for _, book := range books {
+		if !fn(book) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) List() ([]Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.books) == 0 {
+		return nil, nil
+	}
+	return append([]Book(nil), s.books...), nil
+}
+
+func (s *memoryStore) Get(id string) (Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, book := range s.books {
+		if book.ID == id {
+			return book, nil
+		}
+	}
+	return Book{}, errBookNotFound
+}
+
+func (s *memoryStore) Insert(book Book) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.books = append(s.books, book)
+	s.seeID(book.ID)
+	return nil
+}
+
+func (s *memoryStore) Replace(book Book) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.books {
+		if s.books[i].ID == book.ID {
+			s.books[i] = book
+			return nil
+		}
+	}
+	return errBookNotFound
+}
+
+func (s *memoryStore) Remove(ids []string) ([]Book, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var removed []Book
+	kept := s.books[:0]
+	for _, book := range s.books {
+		if contains(ids, book.ID) {
+			removed = append(removed, book)
+			continue
+		}
+		kept = append(kept, book)
+	}
+	s.books = kept
+	if len(removed) == 0 {
+		return nil, errBookNotFound
+	}
+	return removed, nil
+}
+
+func (s *memoryStore) ReplaceAll(books []Book) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.books = append([]Book(nil), books...)
+	for _, book := range books {
+		s.seeID(book.ID)
+	}
+	return nil
+}
+
+func (s *memoryStore) LastID() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastID, nil
+}
+
+func (s *memoryStore) AdvanceID(last int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last > s.lastID {
+		s.lastID = last
+	}
+	return nil
+}
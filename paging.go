@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultPageSize = 10
+
+// parseSortKey splits "year" or "-year" (descending) into a field and a direction
+func parseSortKey(key string) (string, bool, error) {
+	key = strings.ToLower(strings.TrimSpace(key))
+	desc := strings.HasPrefix(key, "-")
+	field := strings.TrimPrefix(key, "-")
+	if !contains(bookFields, field) {
+		return "", false, fmt.Errorf("неизвестное поле для сортировки: %s", field)
+	}
+	return field, desc, nil
+}
+
+// sortBooks orders books by field: numbers and dates by value, text without
+// regard to case. Books with an empty field always go last
+func sortBooks(books []Book, field string, desc bool) {
+	sort.SliceStable(books, func(i, j int) bool {
+		a, b := books[i].getField(field), books[j].getField(field)
+		if a == "" || b == "" {
+			return a != "" && b == ""
+		}
+		cmp, ok := compareFieldValues(field, a, b)
+		if !ok {
+			cmp = strings.Compare(a, b)
+		}
+		if desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+}
+
+// pageInfo describes which part of a result a page holds
+type pageInfo struct {
+	Page  int `json:"page"`
+	Pages int `json:"pages"`
+	Size  int `json:"size"`
+	Total int `json:"total"`
+}
+
+// paginate returns the books of page (counted from 1) and where it lies in
+// the result. A page beyond the last one is clamped to it
+func paginate(books []Book, page, size int) ([]Book, pageInfo) {
+	if size <= 0 {
+		size = defaultPageSize
+	}
+	info := pageInfo{Size: size, Total: len(books), Pages: (len(books) + size - 1) / size}
+	if info.Pages == 0 {
+		info.Pages = 1
+	}
+	info.Page = min(max(page, 1), info.Pages)
+
+	start := (info.Page - 1) * size
+	end := min(start+size, len(books))
+	return books[start:end], info
+}
+
+// pager keeps the last list shown in a menu session and moves through it page by page
+type pager struct {
+	books     []Book
+	page      int
+	size      int
+	sortField string
+	sortDesc  bool
+}
+
+func newPager() *pager {
+	return &pager{size: defaultPageSize}
+}
+
+// setSort remembers the order for the next lists and re-sorts the current one
+func (p *pager) setSort(key string) error {
+	if strings.TrimSpace(key) == "" {
+		p.sortField, p.sortDesc = "", false
+		return nil
+	}
+	field, desc, err := parseSortKey(key)
+	if err != nil {
+		return err
+	}
+	p.sortField, p.sortDesc = field, desc
+	sortBooks(p.books, field, desc)
+	p.page = 1
+	return nil
+}
+
+// show replaces the list and renders its first page
+func (p *pager) show(books []Book) string {
+	p.books = books
+	if p.sortField != "" {
+		sortBooks(p.books, p.sortField, p.sortDesc)
+	}
+	p.page = 1
+	return p.render()
+}
+
+func (p *pager) next() string {
+	if p.books == nil {
+		return "Сначала выведите или найдите книги"
+	}
+	if _, info := paginate(p.books, p.page, p.size); p.page >= info.Pages {
+		return "Это последняя страница"
+	}
+	p.page++
+	return p.render()
+}
+
+func (p *pager) prev() string {
+	if p.books == nil {
+		return "Сначала выведите или найдите книги"
+	}
+	if p.page <= 1 {
+		return "Это первая страница"
+	}
+	p.page--
+	return p.render()
+}
+
+// setSize changes how many books a page holds and goes back to the first page
+func (p *pager) setSize(input string) error {
+	size, err := strconv.Atoi(strings.TrimSpace(input))
+	if err != nil || size <= 0 {
+		return fmt.Errorf("размер страницы должен быть положительным числом")
+	}
+	p.size = size
+	p.page = 1
+	return nil
+}
+
+// goTo renders the given page; a page beyond the last one shows the last
+func (p *pager) goTo(input string) string {
+	if p.books == nil {
+		return "Сначала выведите или найдите книги"
+	}
+	page, err := strconv.Atoi(strings.TrimSpace(input))
+	if err != nil || page <= 0 {
+		return "Ошибка: номер страницы должен быть положительным числом"
+	}
+	p.page = page
+	return p.render()
+}
+
+func (p *pager) render() string {
+	if len(p.books) == 0 {
+		return formatBookList(p.books)
+	}
+	books, info := paginate(p.books, p.page, p.size)
+	p.page = info.Page
+	return formatBookPage(books, info)
+}
+
+// listOptions are the sorting and paging parameters of the JSON protocol and
+// the HTTP API. Sort is a field name, with "-" in front for descending order
+type listOptions struct {
+	Sort string `json:"sort,omitempty"`
+	Page int    `json:"page,omitempty"`
+	Size int    `json:"size,omitempty"`
+}
+
+// apply sorts books and cuts out the requested page. Without page and size
+// the whole list is returned and info is nil
+func (o listOptions) apply(books []Book) ([]Book, *pageInfo, error) {
+	if o.Sort != "" {
+		field, desc, err := parseSortKey(o.Sort)
+		if err != nil {
+			return nil, nil, &FieldError{Field: "sort", Err: err}
+		}
+		sortBooks(books, field, desc)
+	}
+	if o.Page == 0 && o.Size == 0 {
+		return nonNilBooks(books), nil, nil
+	}
+	if o.Page < 0 || o.Size < 0 {
+		return nil, nil, &FieldError{Field: "page", Err: fmt.Errorf("номер и размер страницы должны быть положительными")}
+	}
+	page, info := paginate(books, o.Page, o.Size)
+	return nonNilBooks(page), &info, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// numberedBooks returns books with IDs 1..n
+func numberedBooks(n int) []Book {
+	books := make([]Book, n)
+	for i := range books {
+		books[i] = Book{ID: fmt.Sprint(i + 1)}
+	}
+	return books
+}
+
+// bookIDs returns the IDs of books in order
+func bookIDs(books []Book) []string {
+	ids := []string{}
+	for _, book := range books {
+		ids = append(ids, book.ID)
+	}
+	return ids
+}
+
+// TestPaginate checks page bounds: pages before the first and after the last
+// are clamped, and an empty result still has one page
+func TestPaginate(t *testing.T) {
+	cases := []struct {
+		count, page, size int
+		wantIDs           []string
+		want              pageInfo
+	}{
+		{25, 1, 10, []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"}, pageInfo{1, 3, 10, 25}},
+		{25, 3, 10, []string{"21", "22", "23", "24", "25"}, pageInfo{3, 3, 10, 25}},
+		{25, 99, 10, []string{"21", "22", "23", "24", "25"}, pageInfo{3, 3, 10, 25}},
+		{25, -1, 10, []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"}, pageInfo{1, 3, 10, 25}},
+		{20, 2, 10, []string{"11", "12", "13", "14", "15", "16", "17", "18", "19", "20"}, pageInfo{2, 2, 10, 20}},
+		{3, 2, 0, []string{"1", "2", "3"}, pageInfo{1, 1, defaultPageSize, 3}},
+		{0, 5, 10, []string{}, pageInfo{1, 1, 10, 0}},
+	}
+	for _, c := range cases {
+		page, info := paginate(numberedBooks(c.count), c.page, c.size)
+		if got := bookIDs(page); !reflect.DeepEqual(got, c.wantIDs) || info != c.want {
+			t.Errorf("%d книг, страница %d по %d: %v %+v, ожидалось %v %+v",
+				c.count, c.page, c.size, got, info, c.wantIDs, c.want)
+		}
+	}
+}
+
+// TestSortBooks checks that numbers and dates are sorted by value and books
+// with an empty field go last in both directions
+func TestSortBooks(t *testing.T) {
+	books := []Book{
+		{ID: "1", Score: "9", Read: "05-03-2021"},
+		{ID: "2", Score: "", Read: ""},
+		{ID: "3", Score: "10", Read: "01-12-2020"},
+		{ID: "4", Score: "2", Read: "10-01-2022"},
+	}
+	cases := []struct {
+		key  string
+		want []string
+	}{
+		{"score", []string{"4", "1", "3", "2"}},
+		{"-score", []string{"3", "1", "4", "2"}},
+		{"read", []string{"3", "1", "4", "2"}},
+		{"-READ", []string{"4", "1", "3", "2"}},
+	}
+	for _, c := range cases {
+		sorted := append([]Book(nil), books...)
+		field, desc, err := parseSortKey(c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sortBooks(sorted, field, desc)
+		if got := bookIDs(sorted); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("сортировка %s: %v, ожидалось %v", c.key, got, c.want)
+		}
+	}
+}
+
+// TestListOptions checks the sort and page parameters of the JSON protocol
+// and the HTTP API
+func TestListOptions(t *testing.T) {
+	page, info, err := listOptions{Sort: "-id", Page: 2, Size: 2}.apply(numberedBooks(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bookIDs(page); !reflect.DeepEqual(got, []string{"3", "2"}) || *info != (pageInfo{2, 3, 2, 5}) {
+		t.Errorf("страница 2 по убыванию id: %v %+v", got, *info)
+	}
+
+	all, info, err := listOptions{}.apply(nil)
+	if err != nil || info != nil || all == nil {
+		t.Errorf("без страницы: %v %+v %v, ожидался пустой список без страницы", all, info, err)
+	}
+
+	var fieldErr *FieldError
+	for _, opts := range []listOptions{{Page: -1}, {Size: -5}, {Sort: "publisher"}} {
+		if _, _, err := opts.apply(numberedBooks(3)); !errors.As(err, &fieldErr) {
+			t.Errorf("%+v: %v, ожидалась ошибка поля", opts, err)
+		}
+	}
+}
+
+// TestPagerBounds checks that the menu pager doesn't move past the first or
+// the last page
+func TestPagerBounds(t *testing.T) {
+	p := newPager()
+	if got := p.next(); got != "Сначала выведите или найдите книги" {
+		t.Errorf("next без списка: %q", got)
+	}
+	p.show(numberedBooks(15))
+	if got := p.prev(); got != "Это первая страница" {
+		t.Errorf("prev на первой странице: %q", got)
+	}
+	p.next()
+	if p.page != 2 {
+		t.Fatalf("после next страница %d", p.page)
+	}
+	if got := p.next(); got != "Это последняя страница" || p.page != 2 {
+		t.Errorf("next на последней странице: %q, страница %d", got, p.page)
+	}
+}
+
+// TestPagerSizeAndJump checks the page size and jump-to-page menu commands
+func TestPagerSizeAndJump(t *testing.T) {
+	p := newPager()
+	if got := p.goTo("2"); got != "Сначала выведите или найдите книги" {
+		t.Errorf("goTo без списка: %q", got)
+	}
+	p.show(numberedBooks(25))
+	p.next()
+
+	for _, input := range []string{"", "0", "-3", "abc"} {
+		if err := p.setSize(input); err == nil {
+			t.Errorf("setSize(%q) без ошибки", input)
+		}
+	}
+	if p.size != defaultPageSize || p.page != 2 {
+		t.Fatalf("после неверного размера: size %d, страница %d", p.size, p.page)
+	}
+
+	if err := p.setSize(" 4 "); err != nil {
+		t.Fatal(err)
+	}
+	if p.page != 1 {
+		t.Errorf("после setSize страница %d, ожидалась 1", p.page)
+	}
+	if got, _ := paginate(p.books, p.page, p.size); !reflect.DeepEqual(bookIDs(got), []string{"1", "2", "3", "4"}) {
+		t.Errorf("первая страница по 4: %v", bookIDs(got))
+	}
+
+	p.goTo("3")
+	if got, _ := paginate(p.books, p.page, p.size); p.page != 3 || !reflect.DeepEqual(bookIDs(got), []string{"9", "10", "11", "12"}) {
+		t.Errorf("страница %d: %v", p.page, bookIDs(got))
+	}
+	if p.goTo("100"); p.page != 7 {
+		t.Errorf("goTo за последнюю страницу: страница %d, ожидалась 7", p.page)
+	}
+	for _, input := range []string{"0", "x"} {
+		if got := p.goTo(input); got != "Ошибка: номер страницы должен быть положительным числом" || p.page != 7 {
+			t.Errorf("goTo(%q): %q, страница %d", input, got, p.page)
+		}
+	}
+}
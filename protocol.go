@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// jsonHandshake switches a TCP session from the menu dialogue to the
+// JSON-lines protocol: one request object per line, one response object per line
+const jsonHandshake = "json"
+
+const jsonProtocolVersion = 1
+
+// Коды ошибок JSON-протокола
+const (
+	codeBadRequest = "bad_request"
+	codeUnknownOp  = "unknown_op"
+	codeValidation = "validation"
+	codeDuplicate  = "duplicate"
+	codeNotFound   = "not_found"
+	codeLocked     = "locked"
+	codeInternal   = "internal"
+	// codeUnauthorized is only used by the HTTP API: TCP sessions log in
+	// before the handshake
+	codeUnauthorized = "unauthorized"
+	codeForbidden    = "forbidden"
+	codeTooLarge     = "too_large"
+	codeShutdown     = "shutdown"
+	codeTimeout      = "timeout"
+)
+
+type jsonRequest struct {
+	Op    string          `json:"op"`
+	Book  json.RawMessage `json:"book,omitempty"` // Book для create, bookPatch для update
+	ID    string          `json:"id,omitempty"`
+	IDs   []string        `json:"ids,omitempty"`
+	Field string          `json:"field,omitempty"`
+	Value string          `json:"value,omitempty"`
+	Exact bool            `json:"exact,omitempty"` // search: целое значение, а не подстрока
+	Query string          `json:"query,omitempty"`
+	All   bool            `json:"all,omitempty"`
+	// Версии для history, diff и revert
+	Version int `json:"version,omitempty"`
+	From    int `json:"from,omitempty"`
+	To      int `json:"to,omitempty"`
+	rangeBounds
+	listOptions
+}
+
+type jsonResponse struct {
+	Status string      `json:"status"`
+	Code   string      `json:"code,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Field  string      `json:"field,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+	Page   *pageInfo   `json:"page,omitempty"`
+}
+
+func okResponse(data interface{}) jsonResponse {
+	return jsonResponse{Status: "ok", Data: data}
+}
+
+func errorResponse(code string, err error) jsonResponse {
+	resp := jsonResponse{Status: "error", Code: code, Error: err.Error()}
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		resp.Field = fieldErr.Field
+		resp.Error = fieldErr.Err.Error()
+	}
+	return resp
+}
+
+// storageErrorResponse maps errors returned by the storage functions to protocol codes
+func storageErrorResponse(err error) jsonResponse {
+	switch {
+	case errors.Is(err, errBookExists):
+		return errorResponse(codeDuplicate, err)
+	case errors.Is(err, errBookNotFound), errors.Is(err, errNotInTrash), errors.Is(err, errVersionNotFound):
+		return errorResponse(codeNotFound, err)
+	}
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		return errorResponse(codeValidation, err)
+	}
+	var lockedErr *LockedError
+	if errors.As(err, &lockedErr) {
+		return errorResponse(codeLocked, err)
+	}
+	return errorResponse(codeInternal, err)
+}
+
+// serveJSON handles a session after the jsonHandshake line until the client
+// sends {"op":"exit"} or closes the connection
+func serveJSON(scanner *bufio.Scanner, sendMessage func(string), remoteAddr string, r role) {
+	send := func(resp jsonResponse) {
+		data, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("Ошибка кодирования ответа для %s: %v", remoteAddr, err)
+			return
+		}
+		sendMessage(string(data))
+	}
+
+	send(okResponse(map[string]interface{}{"protocol": "jsonl", "version": jsonProtocolVersion}))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		log.Printf("%s прислал: %s", remoteAddr, line)
+
+		var req jsonRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			send(errorResponse(codeBadRequest, err))
+			continue
+		}
+		if req.Op == "exit" {
+			send(okResponse(nil))
+			log.Printf("Соединение с %s закрыто по команде exit", remoteAddr)
+			return
+		}
+		send(handleJSONRequest(req, remoteAddr, r))
+	}
+	if sessions.shuttingDown() {
+		send(errorResponse(codeShutdown, errShuttingDown))
+	} else if isTimeout(scanner.Err()) {
+		log.Printf("Сеанс %s закрыт из-за бездействия", remoteAddr)
+		send(errorResponse(codeTimeout, errIdleTimeout))
+	} else if err := scanner.Err(); err != nil {
+		log.Printf("Ошибка чтения от %s: %v", remoteAddr, err)
+	}
+}
+
+// handleJSONRequest performs one request on behalf of client, if its role allows
+func handleJSONRequest(req jsonRequest, client string, r role) jsonResponse {
+	if required, ok := jsonOpRoles[req.Op]; ok && !r.allows(required) {
+		log.Printf("%s (%s): отказано в операции %s", client, r, req.Op)
+		return errorResponse(codeForbidden, errForbidden)
+	}
+
+	switch req.Op {
+	case "read":
+		books, err := Read()
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		return listResponse(books, req.listOptions)
+
+	case "get":
+		books, err := searchBooks("id", req.ID)
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		if len(books) == 0 {
+			return errorResponse(codeNotFound, errBookNotFound)
+		}
+		return okResponse(books[0])
+
+	case "search":
+		if !contains(bookFields, req.Field) {
+			return errorResponse(codeValidation, &FieldError{Field: "field", Err: errors.New("неизвестное поле: " + req.Field)})
+		}
+		books, err := findBooks(req.Field, req.Value, req.Exact)
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		return listResponse(books, req.listOptions)
+
+	case "query":
+		query, err := ParseQuery(req.Query)
+		if err != nil {
+			return errorResponse(codeValidation, &FieldError{Field: "query", Err: err})
+		}
+		books, err := queryBooks(query)
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		return listResponse(books, req.listOptions)
+
+	case "range":
+		query, err := RangeQuery(req.Field, req.rangeBounds)
+		if err != nil {
+			return errorResponse(codeValidation, &FieldError{Field: req.Field, Err: err})
+		}
+		books, err := queryBooks(query)
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		return listResponse(books, req.listOptions)
+
+	case "create":
+		if req.Book == nil {
+			return errorResponse(codeBadRequest, errors.New("не передана книга"))
+		}
+		var book Book
+		if err := json.Unmarshal(req.Book, &book); err != nil {
+			return errorResponse(codeBadRequest, err)
+		}
+		book, err := validateBook(book)
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		created, err := createBook(book, client)
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		return okResponse(created)
+
+	case "update":
+		if req.Book == nil {
+			return errorResponse(codeBadRequest, errors.New("не передана книга"))
+		}
+		var patch bookPatch
+		if err := json.Unmarshal(req.Book, &patch); err != nil {
+			return errorResponse(codeBadRequest, err)
+		}
+		book, err := patchBook(patch["id"], patch, client)
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		return okResponse(book)
+
+	case "stats":
+		stats, err := libraryStatistics()
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		return okResponse(stats)
+
+	case "delete":
+		ids := req.IDs
+		if req.ID != "" {
+			ids = append(ids, req.ID)
+		}
+		var books []Book
+		for _, id := range ids {
+			books = append(books, Book{ID: strings.TrimSpace(id)})
+		}
+		deleted, err := modifyBooks(books, false, client)
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		return okResponse(deleted)
+
+	case "history":
+		entries, err := bookHistory(strings.TrimSpace(req.ID))
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		return okResponse(entries)
+
+	case "diff":
+		changes, err := diffVersions(strings.TrimSpace(req.ID), req.From, req.To)
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		return okResponse(changes)
+
+	case "revert":
+		book, err := revertBook(strings.TrimSpace(req.ID), req.Version, client)
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		return okResponse(book)
+
+	case "trash":
+		entries, err := listTrash()
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		return okResponse(nonNilTrash(entries))
+
+	case "restore":
+		book, err := restoreFromTrash(strings.TrimSpace(req.ID), client)
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		return okResponse(book)
+
+	case "purge":
+		ids := req.IDs
+		if req.ID != "" {
+			ids = append(ids, req.ID)
+		}
+		if len(ids) == 0 && !req.All {
+			return errorResponse(codeBadRequest, errors.New("укажите id, ids или all"))
+		}
+		purged, err := purgeTrash(ids)
+		if err != nil {
+			return storageErrorResponse(err)
+		}
+		return okResponse(nonNilTrash(purged))
+	}
+
+	return errorResponse(codeUnknownOp, errors.New("неизвестная операция: "+req.Op))
+}
+
+// bookPatch is the body of an update: the fields the client sent, by name.
+// A field sent as "" (or null) is cleared, a field left out keeps its value
+type bookPatch map[string]string
+
+func (p *bookPatch) UnmarshalJSON(data []byte) error {
+	var fields map[string]*string
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	patch := make(bookPatch, len(fields))
+	for name, value := range fields {
+		if !isBookField(name) {
+			return fmt.Errorf("неизвестное поле %q", name)
+		}
+		if value != nil {
+			patch[name] = *value
+		} else {
+			patch[name] = ""
+		}
+	}
+	*p = patch
+	return nil
+}
+
+func isBookField(name string) bool {
+	for _, field := range bookFields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// patchBook applies the fields of patch to the stored book and saves it.
+// Reading, merging and writing happen under one exclusive lock, so two
+// clients changing different fields of a book at once both keep their
+// change. Every sent field goes through setField like in the interactive
+// update dialogue, an empty one too: read, score and review may be cleared,
+// the required fields may not. replaceBook then checks the merged book as a
+// whole and refuses a name and authors another book already has
+func patchBook(id string, patch bookPatch, client string) (Book, error) {
+	unlock, err := lockDB(true)
+	if err != nil {
+		return Book{}, err
+	}
+	defer unlock()
+
+	current, err := store.Get(id)
+	if err != nil {
+		return Book{}, err
+	}
+	book := current
+	for _, field := range editableFields {
+		value, ok := patch[field]
+		if !ok {
+			continue
+		}
+		if err := book.setField(field, strings.TrimSpace(value)); err != nil {
+			return Book{}, &FieldError{Field: field, Err: err}
+		}
+	}
+	if book == current {
+		return book, nil
+	}
+	if err := replaceBook(book, client); err != nil {
+		return Book{}, err
+	}
+	return book, nil
+}
+
+// listResponse sorts and pages a list of books as the request asks
+func listResponse(books []Book, opts listOptions) jsonResponse {
+	page, info, err := opts.apply(books)
+	if err != nil {
+		return storageErrorResponse(err)
+	}
+	resp := okResponse(page)
+	resp.Page = info
+	return resp
+}
+
+func nonNilTrash(entries []trashEntry) []trashEntry {
+	if entries == nil {
+		return []trashEntry{}
+	}
+	return entries
+}
+
+// nonNilBooks makes empty results encode as [] instead of null
+func nonNilBooks(books []Book) []Book {
+	if books == nil {
+		return []Book{}
+	}
+	return books
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Query is a parsed search condition over book fields
+type Query interface {
+	Match(book *Book) bool
+}
+
+// numericFields and dateFields are compared by value, not as text
+var (
+	numericFields = []string{"id", "year", "width", "height", "score"}
+	dateFields    = []string{"added", "read"}
+)
+
+const dateLayout = "02-01-2006"
+
+type andQuery struct{ left, right Query }
+
+func (q andQuery) Match(book *Book) bool { return q.left.Match(book) && q.right.Match(book) }
+
+type orQuery struct{ left, right Query }
+
+func (q orQuery) Match(book *Book) bool { return q.left.Match(book) || q.right.Match(book) }
+
+type notQuery struct{ inner Query }
+
+func (q notQuery) Match(book *Book) bool { return !q.inner.Match(book) }
+
+// condition compares one field with a value. Text fields are compared
+// without regard to case; numeric fields and dates by their value
+type condition struct {
+	field string
+	op    string
+	value string
+}
+
+func (c condition) Match(book *Book) bool {
+	actual := book.getField(c.field)
+
+	switch c.op {
+	case "~":
+		return strings.Contains(strings.ToLower(actual), strings.ToLower(c.value))
+	case "^":
+		return strings.HasPrefix(strings.ToLower(actual), strings.ToLower(c.value))
+	}
+
+	// Пустое значение сравнивается только на равенство
+	if actual == "" || c.value == "" {
+		switch c.op {
+		case "=":
+			return actual == c.value
+		case "!=":
+			return actual != c.value
+		}
+		return false
+	}
+
+	cmp, ok := compareFieldValues(c.field, actual, c.value)
+	if !ok {
+		return false
+	}
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// compareFieldValues compares two values of a field: numerically, as
+// dates or case-insensitively as text. ok is false if a value doesn't parse
+func compareFieldValues(field, a, b string) (int, bool) {
+	switch {
+	case contains(numericFields, field):
+		x, errA := strconv.ParseFloat(a, 64)
+		y, errB := strconv.ParseFloat(b, 64)
+		if errA != nil || errB != nil {
+			return 0, false
+		}
+		return compareFloats(x, y), true
+
+	case contains(dateFields, field):
+		x, errA := time.Parse(dateLayout, a)
+		y, errB := time.Parse(dateLayout, b)
+		if errA != nil || errB != nil {
+			return 0, false
+		}
+		return x.Compare(y), true
+	}
+
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b)), true
+}
+
+func compareFloats(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// newCondition checks that op can be applied to field and value
+func newCondition(field, op, value string) (Query, error) {
+	if !contains(bookFields, field) {
+		return nil, fmt.Errorf("неизвестное поле: %s", field)
+	}
+
+	switch op {
+	case "=", "!=", "~", "^":
+	case "<", "<=", ">", ">=":
+		if !contains(numericFields, field) && !contains(dateFields, field) {
+			return nil, fmt.Errorf("оператор %s применим только к числовым полям и датам, а не к %s", op, field)
+		}
+	default:
+		return nil, fmt.Errorf("неизвестный оператор: %s", op)
+	}
+
+	if value != "" && (op != "~" && op != "^") {
+		if contains(numericFields, field) {
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, fmt.Errorf("значение %q для поля %s должно быть числом", value, field)
+			}
+		}
+		if contains(dateFields, field) {
+			if _, err := time.Parse(dateLayout, value); err != nil {
+				return nil, fmt.Errorf("значение %q для поля %s должно быть датой ДД-ММ-ГГГГ", value, field)
+			}
+		}
+	}
+
+	return condition{field: field, op: op, value: value}, nil
+}
+
+// ParseQuery parses a query such as
+//
+//	genres ~ Фантастика AND year >= 1950 AND read = ""
+//
+// Conditions are "field operator value" with operators = != ~ (contains)
+// ^ (starts with) < <= > >=. They are combined with AND, OR, NOT (or И,
+// ИЛИ, НЕ) and parentheses. Values with spaces go in double quotes
+func ParseQuery(input string) (Query, error) {
+	tokens, err := tokenizeQuery(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("пустой запрос")
+	}
+
+	p := &queryParser{tokens: tokens}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("лишний текст в запросе: %s", p.peek().text)
+	}
+	return q, nil
+}
+
+type queryToken struct {
+	text   string
+	quoted bool
+}
+
+var queryOperators = []string{"<=", ">=", "!=", "=", "~", "^", "<", ">"}
+
+func tokenizeQuery(input string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(' || r == ')':
+			tokens = append(tokens, queryToken{text: string(r)})
+			i++
+
+		case r == '"':
+			var value strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("незакрытая кавычка в запросе")
+			}
+			i++
+			tokens = append(tokens, queryToken{text: value.String(), quoted: true})
+
+		default:
+			if op := operatorAt(runes[i:]); op != "" {
+				tokens = append(tokens, queryToken{text: op})
+				i += len([]rune(op))
+				continue
+			}
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' &&
+				runes[i] != '"' && operatorAt(runes[i:]) == "" {
+				i++
+			}
+			tokens = append(tokens, queryToken{text: string(runes[start:i])})
+		}
+	}
+	return tokens, nil
+}
+
+func operatorAt(runes []rune) string {
+	for _, op := range queryOperators {
+		if strings.HasPrefix(string(runes[:min(len(runes), 2)]), op) {
+			return op
+		}
+	}
+	return ""
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) done() bool { return p.pos >= len(p.tokens) }
+
+func (p *queryParser) peek() queryToken {
+	if p.done() {
+		return queryToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+// keyword reports whether the next token is one of the given unquoted keywords and consumes it
+func (p *queryParser) keyword(words ...string) bool {
+	t := p.peek()
+	if p.done() || t.quoted {
+		return false
+	}
+	for _, w := range words {
+		if strings.EqualFold(t.text, w) {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *queryParser) parseOr() (Query, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR", "ИЛИ") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orQuery{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (Query, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND", "И") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andQuery{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseNot() (Query, error) {
+	if p.keyword("NOT", "НЕ") {
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notQuery{inner}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (Query, error) {
+	if p.done() {
+		return nil, fmt.Errorf("запрос оборван: ожидалось условие")
+	}
+
+	if t := p.peek(); !t.quoted && t.text == "(" {
+		p.pos++
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.peek(); p.done() || t.quoted || t.text != ")" {
+			return nil, fmt.Errorf("незакрытая скобка в запросе")
+		}
+		p.pos++
+		return q, nil
+	}
+
+	field := p.peek()
+	if field.quoted {
+		return nil, fmt.Errorf("ожидалось имя поля, получено %q", field.text)
+	}
+	p.pos++
+
+	op := p.peek()
+	if p.done() || op.quoted || !contains(queryOperators, op.text) {
+		return nil, fmt.Errorf("ожидался оператор после поля %s", field.text)
+	}
+	p.pos++
+
+	value := p.peek()
+	if p.done() || (!value.quoted && (value.text == "(" || value.text == ")")) {
+		return nil, fmt.Errorf("ожидалось значение после %s %s", field.text, op.text)
+	}
+	p.pos++
+
+	return newCondition(strings.ToLower(field.text), op.text, value.text)
+}
+
+// queryBooks returns the books that match q in storage order
+func queryBooks(q Query) ([]Book, error) {
+	unlock, err := lockDB(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var results []Book
+	err = store.Scan(func(book Book) bool {
+		if q.Match(&book) {
+			results = append(results, book)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// rangeBounds limits a numeric or date field. Min and Max are inclusive,
+// After and Before are strict; empty bounds are not applied
+type rangeBounds struct {
+	Min    string `json:"min,omitempty"`
+	Max    string `json:"max,omitempty"`
+	After  string `json:"after,omitempty"`
+	Before string `json:"before,omitempty"`
+}
+
+// RangeQuery builds a query for books whose field lies within bounds. For
+// date fields a bound may also be a month (ММ-ГГГГ) or a year (ГГГГ):
+// min 2022 and max 2022 select the whole of 2022
+func RangeQuery(field string, bounds rangeBounds) (Query, error) {
+	if !contains(numericFields, field) && !contains(dateFields, field) {
+		return nil, fmt.Errorf("диапазон поддерживается только для полей %s и %s",
+			strings.Join(numericFields, ", "), strings.Join(dateFields, ", "))
+	}
+
+	var q Query
+	for _, bound := range []struct {
+		op    string
+		value string
+		upper bool
+	}{
+		{">=", bounds.Min, false},
+		{"<=", bounds.Max, true},
+		{">", bounds.After, true},
+		{"<", bounds.Before, false},
+	} {
+		value := strings.TrimSpace(bound.value)
+		if value == "" {
+			continue
+		}
+		if contains(dateFields, field) {
+			expanded, err := expandDateBound(value, bound.upper)
+			if err != nil {
+				return nil, err
+			}
+			value = expanded
+		}
+
+		cond, err := newCondition(field, bound.op, value)
+		if err != nil {
+			return nil, err
+		}
+		if q == nil {
+			q = cond
+		} else {
+			q = andQuery{q, cond}
+		}
+	}
+
+	if q == nil {
+		return nil, fmt.Errorf("не задана ни одна граница диапазона")
+	}
+	return q, nil
+}
+
+// expandDateBound turns ГГГГ or ММ-ГГГГ into the first (upper == false) or
+// the last (upper == true) day of that period; ДД-ММ-ГГГГ is returned as is
+func expandDateBound(value string, upper bool) (string, error) {
+	for _, layout := range []struct {
+		layout string
+		years  int
+		months int
+	}{
+		{dateLayout, 0, 0},
+		{"01-2006", 0, 1},
+		{"2006", 1, 0},
+	} {
+		start, err := time.Parse(layout.layout, value)
+		if err != nil {
+			continue
+		}
+		if upper && (layout.years > 0 || layout.months > 0) {
+			start = start.AddDate(layout.years, layout.months, -1)
+		}
+		return start.Format(dateLayout), nil
+	}
+	return "", fmt.Errorf("граница %q должна быть датой ДД-ММ-ГГГГ, месяцем ММ-ГГГГ или годом ГГГГ", value)
+}
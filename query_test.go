@@ -0,0 +1,163 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// queryTestBooks are the books the query tests search through
+var queryTestBooks = []Book{
+	{ID: "1", Name: "Дюна", Genres: "Фантастика", Year: "1965", Added: "01-01-2020"},
+	{ID: "2", Name: "Война и мир", Genres: "Роман", Year: "1869", Added: "01-01-2020", Read: "02-01-2020", Score: "9"},
+	{ID: "3", Name: "Солярис", Genres: "Фантастика, Роман", Year: "1961", Added: "01-01-2020", Read: "03-01-2020", Score: "10"},
+}
+
+// matchingIDs returns the IDs of the books that q matches, in order
+func matchingIDs(q Query, books []Book) []string {
+	ids := []string{}
+	for _, book := range books {
+		if q.Match(&book) {
+			ids = append(ids, book.ID)
+		}
+	}
+	return ids
+}
+
+// TestParseQuery checks operator precedence, parentheses, keywords in both
+// languages and quoted values by the books each query finds
+func TestParseQuery(t *testing.T) {
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		// AND связывает сильнее OR, NOT — сильнее AND
+		{`genres ~ Фантастика AND year >= 1962 OR year < 1900`, []string{"1", "2"}},
+		{`genres ~ Фантастика AND (year >= 1962 OR year < 1900)`, []string{"1"}},
+		{`year < 1900 OR genres ~ фантастика AND score >= 10`, []string{"2", "3"}},
+		{`NOT genres ~ Фантастика OR year = 1965`, []string{"1", "2"}},
+		{`НЕ (genres ~ Фантастика ИЛИ year = 1869)`, []string{}},
+		{`not not year = 1961`, []string{"3"}},
+		{`((year > 1900) and (year < 1962))`, []string{"3"}},
+		// Пустое значение и значения в кавычках
+		{`read = ""`, []string{"1"}},
+		{`score != ""`, []string{"2", "3"}},
+		{`name = "война и мир"`, []string{"2"}},
+		{`name ^ сол И read > 02-01-2020`, []string{"3"}},
+		{`score>9`, []string{"3"}},
+	}
+	for _, c := range cases {
+		q, err := ParseQuery(c.query)
+		if err != nil {
+			t.Errorf("%s: %v", c.query, err)
+			continue
+		}
+		if got := matchingIDs(q, queryTestBooks); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: найдены %v, ожидались %v", c.query, got, c.want)
+		}
+	}
+}
+
+// TestParseQueryErrors checks that malformed queries are refused
+func TestParseQueryErrors(t *testing.T) {
+	for _, query := range []string{
+		``,
+		`   `,
+		`year`,
+		`year >`,
+		`year 1965`,
+		`year >= abc`,
+		`added < 2020-01-01`,
+		`name > Дюна`,
+		`publisher = Эксмо`,
+		`"year" = 1965`,
+		`name = "Дюна`,
+		`(year = 1965`,
+		`year = 1965)`,
+		`year = 1965 AND`,
+		`AND year = 1965`,
+		`year = 1965 year = 1961`,
+		`NOT`,
+		`()`,
+		`year = (`,
+	} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Errorf("запрос %q разобран без ошибки", query)
+		}
+	}
+}
+
+// TestExpandDateBound checks that a year or a month becomes its first day as
+// a lower bound and its last day as an upper one
+func TestExpandDateBound(t *testing.T) {
+	cases := []struct {
+		value string
+		upper bool
+		want  string
+	}{
+		{"2022", false, "01-01-2022"},
+		{"2022", true, "31-12-2022"},
+		{"02-2024", false, "01-02-2024"},
+		{"02-2024", true, "29-02-2024"},
+		{"12-2023", true, "31-12-2023"},
+		{"15-03-2021", true, "15-03-2021"},
+	}
+	for _, c := range cases {
+		got, err := expandDateBound(c.value, c.upper)
+		if err != nil || got != c.want {
+			t.Errorf("expandDateBound(%q, %v) = %q, %v, ожидалось %q", c.value, c.upper, got, err, c.want)
+		}
+	}
+	for _, value := range []string{"2022-01", "13-2022", "32-01-2022", "вчера"} {
+		if _, err := expandDateBound(value, false); err == nil {
+			t.Errorf("граница %q принята", value)
+		}
+	}
+}
+
+// TestRangeQuery checks inclusive and strict bounds over numbers and dates
+func TestRangeQuery(t *testing.T) {
+	books := []Book{
+		{ID: "1", Year: "1999", Added: "31-12-2021"},
+		{ID: "2", Year: "2000", Added: "01-01-2022"},
+		{ID: "3", Year: "2001", Added: "31-12-2022"},
+		{ID: "4", Year: "2002", Added: "01-01-2023"},
+		{ID: "5", Year: "2003", Added: "15-02-2022", Read: "29-02-2024"},
+	}
+	cases := []struct {
+		field  string
+		bounds rangeBounds
+		want   []string
+	}{
+		{"added", rangeBounds{Min: "2022", Max: "2022"}, []string{"2", "3", "5"}},
+		{"added", rangeBounds{Min: "02-2022", Max: "02-2022"}, []string{"5"}},
+		{"added", rangeBounds{After: "01-01-2022", Before: "01-01-2023"}, []string{"3", "5"}},
+		{"read", rangeBounds{Max: "2024"}, []string{"5"}},
+		{"year", rangeBounds{Min: "2000", Max: "2002"}, []string{"2", "3", "4"}},
+		{"year", rangeBounds{After: "2000", Before: "2002"}, []string{"3"}},
+		{"year", rangeBounds{Min: " 2003 "}, []string{"5"}},
+	}
+	for _, c := range cases {
+		q, err := RangeQuery(c.field, c.bounds)
+		if err != nil {
+			t.Errorf("%s %+v: %v", c.field, c.bounds, err)
+			continue
+		}
+		if got := matchingIDs(q, books); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s %+v: найдены %v, ожидались %v", c.field, c.bounds, got, c.want)
+		}
+	}
+
+	for _, c := range []struct {
+		field  string
+		bounds rangeBounds
+	}{
+		{"name", rangeBounds{Min: "А"}},
+		{"year", rangeBounds{}},
+		{"year", rangeBounds{Min: "две тысячи"}},
+		{"added", rangeBounds{Max: "2022-12"}},
+	} {
+		if _, err := RangeQuery(c.field, c.bounds); err == nil {
+			t.Errorf("диапазон %s %+v принят", c.field, c.bounds)
+		}
+	}
+}
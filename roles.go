@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// role is what a user may do. Each role can do everything the previous one can
+type role int
+
+const (
+	// roleReader may read, search and look at statistics and history
+	roleReader role = iota
+	// roleEditor may also add and update books and revert them to older versions
+	roleEditor
+	// roleAdmin may also delete books, manage the trash and run import, dump and restore
+	roleAdmin
+)
+
+// anonymousRole is the role of clients while there are no accounts: they
+// may look at the books, but changing them needs an account
+const anonymousRole = roleReader
+
+var roleNames = []string{"reader", "editor", "admin"}
+
+var errForbidden = errors.New("недостаточно прав")
+
+func (r role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+func parseRole(name string) (role, error) {
+	for i, roleName := range roleNames {
+		if strings.EqualFold(strings.TrimSpace(name), roleName) {
+			return role(i), nil
+		}
+	}
+	return 0, fmt.Errorf("неизвестная роль %q, ожидается reader, editor или admin", name)
+}
+
+// allows reports whether the role is at least required
+func (r role) allows(required role) bool {
+	return r >= required
+}
+
+// menuItem is one action of the main menu and the role it needs
+type menuItem struct {
+	Key   string
+	Title string
+	Role  role
+}
+
+var mainMenu = []menuItem{
+	{"1", "Create", roleEditor},
+	{"2", "Read", roleReader},
+	{"3", "Search", roleReader},
+	{"4", "Delete", roleAdmin},
+	{"5", "Update", roleEditor},
+	{"6", "Статистика", roleReader},
+	{"7", "История изменений", roleReader},
+}
+
+// menuRole returns the role needed for a main menu key; keys that are not
+// actions (0, exit, paging) need none
+func menuRole(key string) role {
+	for _, item := range mainMenu {
+		if item.Key == key {
+			return item.Role
+		}
+	}
+	return roleReader
+}
+
+// jsonOpRoles lists the JSON protocol operations that need more than roleReader
+var jsonOpRoles = map[string]role{
+	"create":  roleEditor,
+	"update":  roleEditor,
+	"revert":  roleEditor,
+	"delete":  roleAdmin,
+	"trash":   roleAdmin,
+	"restore": roleAdmin,
+	"purge":   roleAdmin,
+}
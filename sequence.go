@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// idSequence is a durable counter of the last allocated book ID. An ID is
+// never handed out twice, even after the book that had it is deleted
+type idSequence struct {
+	path string
+}
+
+// load returns the last allocated ID and whether the sequence file exists
+func (q *idSequence) load() (int, bool, error) {
+	data, err := os.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("ошибка чтения последовательности ID: %v", err)
+	}
+
+	last, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false, fmt.Errorf("неверный формат последовательности ID: %v", err)
+	}
+	return last, true, nil
+}
+
+// save stores the last allocated ID, replacing the file atomically
+func (q *idSequence) save(last int) error {
+	tempPath := q.path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("ошибка записи последовательности ID: %v", err)
+	}
+	if _, err := file.WriteString(strconv.Itoa(last) + "\n"); err != nil {
+		file.Close()
+		return fmt.Errorf("ошибка записи последовательности ID: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("ошибка записи последовательности ID: %v", err)
+	}
+	file.Close()
+
+	if err := os.Rename(tempPath, q.path); err != nil {
+		return fmt.Errorf("ошибка записи последовательности ID: %v", err)
+	}
+	return nil
+}
+
+// LastID returns the last allocated ID, or the largest ID in the file if
+// the sequence hasn't been created yet
+func (s *fileStore) LastID() (int, error) {
+	last, ok, err := s.seq.load()
+	if err != nil || ok {
+		return last, err
+	}
+	return s.maxID()
+}
+
+// AdvanceID moves the sequence to last unless it is already past it
+func (s *fileStore) AdvanceID(last int) error {
+	current, err := s.LastID()
+	if err != nil || current >= last {
+		return err
+	}
+	return s.seq.save(last)
+}
+
+// NextID allocates a new ID. The sequence is saved before the book is
+// written, so a crash can leave a gap but never a reused ID
+func (s *fileStore) NextID() (int, error) {
+	last, err := s.LastID()
+	if err != nil {
+		return 0, err
+	}
+
+	next := last + 1
+	if err := s.seq.save(next); err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+// migrateIDs runs once, when the database has no sequence file yet: books
+// whose ID repeats an earlier one or is not a number get fresh IDs after the
+// largest existing one, and the sequence starts from there
+func (s *fileStore) migrateIDs() error {
+	if _, ok, err := s.seq.load(); err != nil || ok {
+		return err
+	}
+
+	maxID, err := s.maxID()
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	renumber := 0
+	err = s.Scan(func(book Book) bool {
+		if _, err := strconv.Atoi(book.ID); err != nil || seen[book.ID] {
+			renumber++
+		}
+		seen[book.ID] = true
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	last := maxID
+	if renumber > 0 {
+		seen = make(map[string]bool)
+		err = s.rewrite(func(book Book) (Book, bool) {
+			if _, err := strconv.Atoi(book.ID); err == nil && !seen[book.ID] {
+				seen[book.ID] = true
+				return book, true
+			}
+			last++
+			log.Printf("Миграция ID: книга %q (%s) получила ID %d вместо %s", book.Name, book.Authors, last, book.ID)
+			book.ID = strconv.Itoa(last)
+			return book, true
+		})
+		if err != nil {
+			return fmt.Errorf("ошибка перенумерации книг: %v", err)
+		}
+	}
+
+	if err := s.seq.save(last); err != nil {
+		return err
+	}
+	log.Printf("Миграция ID: перенумеровано книг: %d, последний выданный ID: %d", renumber, last)
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestMigrateLegacyIDs loads a database without a sequence file whose IDs
+// repeat or are not numbers and checks that only those books get new IDs
+// after the largest one, once
+func TestMigrateLegacyIDs(t *testing.T) {
+	silenceLog(t)
+	s, path := newTempFileStore(t)
+
+	var content strings.Builder
+	content.WriteString(formatHeader(currentFormat))
+	for i, id := range []string{"1", "7", "7", "x", "2"} {
+		book := newTestBook(fmt.Sprintf("Книга %d", i))
+		book.ID = id
+		content.WriteString(bookToLine(book))
+	}
+	if err := os.WriteFile(path, []byte(content.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1", "7", "8", "9", "2"}
+	if got := readBookIDs(t, s); !reflect.DeepEqual(got, want) {
+		t.Errorf("после миграции ID %v, ожидались %v", got, want)
+	}
+	data, err := os.ReadFile(s.seq.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(data)); got != "9" {
+		t.Errorf("последовательность %q, ожидалось 9", got)
+	}
+
+	// Файл последовательности уже есть: повторный запуск ничего не меняет,
+	// а удаленный ID не выдается снова
+	if _, err := s.Remove([]string{"9"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := s.NextID(); err != nil || id != 10 {
+		t.Errorf("следующий ID %d, %v, ожидался 10", id, err)
+	}
+}
+
+// TestSequenceWithoutFile checks that a database without a sequence file
+// continues from its largest ID
+func TestSequenceWithoutFile(t *testing.T) {
+	s, _ := newTempFileStore(t)
+	for _, id := range []string{"3", "12", "5"} {
+		book := newTestBook("Книга " + id)
+		book.ID = id
+		if err := s.Insert(book); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if last, err := s.LastID(); err != nil || last != 12 {
+		t.Errorf("последний ID %d, %v, ожидался 12", last, err)
+	}
+	if id, err := s.NextID(); err != nil || id != 13 {
+		t.Errorf("следующий ID %d, %v, ожидался 13", id, err)
+	}
+	if err := s.AdvanceID(5); err != nil {
+		t.Fatal(err)
+	}
+	if last, err := s.LastID(); err != nil || last != 13 {
+		t.Errorf("AdvanceID сдвинул последовательность назад: %d, %v", last, err)
+	}
+}
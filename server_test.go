@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Учетная запись администратора, которую создает startTestServer
+const (
+	testAdmin    = "admin"
+	testPassword = "secret"
+)
+
+// silenceLog discards the log until the test ends
+func silenceLog(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// useTestDatabase points the server at a fresh database with no accounts
+// in a temporary directory and silences the log
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	silenceLog(t)
+
+	config = defaultConfig()
+	config.DataDir = t.TempDir()
+	config.UsersFile = config.databasePath() + ".users"
+	config.MaxConnections = 0
+	config.MaxPerIP = 0
+	config.apply()
+}
+
+// startTestServer serves handleClient on a random local port over a fresh
+// database and returns the address. With withAdmin the server has the
+// testAdmin account, without it no accounts at all
+func startTestServer(t *testing.T, withAdmin bool) string {
+	t.Helper()
+	useTestDatabase(t)
+	if withAdmin {
+		if err := addUser(testAdmin, testPassword, roleAdmin); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveClients(t, listener)
+	return listener.Addr().String()
+}
+
+// serveClients runs handleClient for every connection to listener until the
+// test ends, then waits for the sessions to finish
+func serveClients(t *testing.T, listener net.Listener) {
+	t.Cleanup(func() {
+		listener.Close()
+		sessions.wg.Wait()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleClient(conn)
+		}
+	}()
+}
+
+// testResponse is a jsonResponse as the client sees it
+type testResponse struct {
+	Status string          `json:"status"`
+	Code   string          `json:"code"`
+	Error  string          `json:"error"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// jsonSession is a client of the JSON-lines protocol
+type jsonSession struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialJSON connects to the server, logs in as testAdmin if login is true and
+// switches the session to JSON
+func dialJSON(addr string, login bool) (*jsonSession, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	s := &jsonSession{conn: conn, reader: bufio.NewReader(conn)}
+	if login {
+		fmt.Fprintf(conn, "%s\n%s\n", testAdmin, testPassword)
+	}
+	fmt.Fprintln(conn, jsonHandshake)
+	// Приветствие, вход и меню идут до ответа на переключение в JSON
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("нет ответа на %q: %v", jsonHandshake, err)
+		}
+		if strings.HasPrefix(line, "{") {
+			return s, nil
+		}
+	}
+}
+
+func (s *jsonSession) do(req map[string]interface{}) (testResponse, error) {
+	var resp testResponse
+	data, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	if _, err := s.conn.Write(append(data, '\n')); err != nil {
+		return resp, err
+	}
+	line, err := s.reader.ReadBytes('\n')
+	if err != nil {
+		return resp, err
+	}
+	return resp, json.Unmarshal(line, &resp)
+}
+
+func (s *jsonSession) close() {
+	s.do(map[string]interface{}{"op": "exit"})
+	s.conn.Close()
+}
+
+// booksPerSession is how many books each session of TestConcurrentSessions adds
+const booksPerSession = 6
+
+func testBook(name string) map[string]string {
+	return map[string]string{
+		"name": name, "authors": "Тестовый Автор", "genres": "Роман",
+		"year": "2000", "width": "100", "height": "200", "cover": "мягкий",
+		"source": "покупка", "added": "01-01-2020",
+	}
+}
+
+// newTestBook is testBook as a Book, for tests that call the storage functions directly
+func newTestBook(name string) Book {
+	return Book{
+		Name: name, Authors: "Тестовый Автор", Genres: "Роман",
+		Year: "2000", Width: "100", Height: "200", Cover: "мягкий",
+		Source: "покупка", Added: "01-01-2020",
+	}
+}
+
+// TestConcurrentSessions runs many sessions at once that create, update,
+// delete and read books, then checks that the file has no torn or duplicate
+// rows and holds exactly the books that were not deleted. Run with -race
+func TestConcurrentSessions(t *testing.T) {
+	addr := startTestServer(t, true)
+
+	const sessionCount = 32
+
+	var mu sync.Mutex
+	kept := make(map[string]string)
+	sharedCreated := 0
+
+	var wg sync.WaitGroup
+	errs := make(chan error, sessionCount)
+	for i := 0; i < sessionCount; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			s, err := dialJSON(addr, true)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer s.close()
+			errs <- runSession(s, n, &mu, kept, &sharedCreated)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if sharedCreated != 1 {
+		t.Errorf("общая книга добавлена %d раз, ожидался 1", sharedCreated)
+	}
+
+	report, err := store.(*fileStore).Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range report.Issues {
+		t.Errorf("строка %d: %s", issue.Line, issue.Problem)
+	}
+
+	books, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, book := range books {
+		if seen[book.ID] {
+			t.Errorf("ID %s повторяется", book.ID)
+		}
+		seen[book.ID] = true
+		score, ok := kept[book.ID]
+		if !ok && book.Name != "Общая книга" {
+			t.Errorf("в базе лишняя книга %s (ID %s)", book.Name, book.ID)
+		}
+		if ok && book.Score != score {
+			t.Errorf("книга %s: оценка %q, ожидалась %q", book.ID, book.Score, score)
+		}
+	}
+	if want := len(kept) + sharedCreated; len(books) != want {
+		t.Errorf("в базе %d книг, ожидалось %d", len(books), want)
+	}
+}
+
+// runSession adds booksPerSession books, updates each, deletes every other
+// one and reads the whole list in between. It also races every other session
+// to add the same shared book, which only one of them may manage
+func runSession(s *jsonSession, n int, mu *sync.Mutex, kept map[string]string, sharedCreated *int) error {
+	resp, err := s.do(map[string]interface{}{"op": "create", "book": testBook("Общая книга")})
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.Status == "ok":
+		mu.Lock()
+		*sharedCreated++
+		mu.Unlock()
+	case resp.Code != codeDuplicate:
+		return fmt.Errorf("сеанс %d: общая книга: %s %s", n, resp.Code, resp.Error)
+	}
+
+	for j := 0; j < booksPerSession; j++ {
+		resp, err := s.do(map[string]interface{}{"op": "create", "book": testBook(fmt.Sprintf("Книга %d %d", n, j))})
+		if err != nil {
+			return err
+		}
+		if resp.Status != "ok" {
+			return fmt.Errorf("сеанс %d: create: %s %s", n, resp.Code, resp.Error)
+		}
+		var created Book
+		if err := json.Unmarshal(resp.Data, &created); err != nil {
+			return err
+		}
+
+		score := fmt.Sprint(j%5 + 1)
+		resp, err = s.do(map[string]interface{}{"op": "update", "book": map[string]string{"id": created.ID, "score": score}})
+		if err != nil {
+			return err
+		}
+		if resp.Status != "ok" {
+			return fmt.Errorf("сеанс %d: update %s: %s %s", n, created.ID, resp.Code, resp.Error)
+		}
+
+		if resp, err = s.do(map[string]interface{}{"op": "read"}); err != nil {
+			return err
+		}
+		if resp.Status != "ok" {
+			return fmt.Errorf("сеанс %d: read: %s %s", n, resp.Code, resp.Error)
+		}
+
+		if j%2 == 1 {
+			resp, err = s.do(map[string]interface{}{"op": "delete", "id": created.ID})
+			if err != nil {
+				return err
+			}
+			if resp.Status != "ok" {
+				return fmt.Errorf("сеанс %d: delete %s: %s %s", n, created.ID, resp.Code, resp.Error)
+			}
+			continue
+		}
+		mu.Lock()
+		kept[created.ID] = score
+		mu.Unlock()
+	}
+	return nil
+}
+
+// TestAnonymousReadOnly checks that without accounts a session may read but
+// not change the database
+func TestAnonymousReadOnly(t *testing.T) {
+	addr := startTestServer(t, false)
+	s, err := dialJSON(addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	for _, req := range []map[string]interface{}{
+		{"op": "create", "book": testBook("Книга")},
+		{"op": "update", "book": map[string]string{"id": "1", "score": "5"}},
+		{"op": "delete", "id": "1"},
+	} {
+		resp, err := s.do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != codeForbidden {
+			t.Errorf("%v: %s %s, ожидался отказ %s", req["op"], resp.Status, resp.Code, codeForbidden)
+		}
+	}
+	resp, err := s.do(map[string]interface{}{"op": "read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "ok" {
+		t.Errorf("read: %s %s", resp.Code, resp.Error)
+	}
+}
+
+// TestUpdateChecksWholeBook checks that an update is validated as a whole
+// book after the merge, not only field by field, and can't copy the name and
+// authors of another book
+func TestUpdateChecksWholeBook(t *testing.T) {
+	addr := startTestServer(t, true)
+	s, err := dialJSON(addr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	var ids []string
+	for _, name := range []string{"Первая книга", "Вторая книга"} {
+		resp, err := s.do(map[string]interface{}{"op": "create", "book": testBook(name)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var created Book
+		if err := json.Unmarshal(resp.Data, &created); err != nil {
+			t.Fatalf("create %s: %s %s", name, resp.Code, resp.Error)
+		}
+		ids = append(ids, created.ID)
+	}
+
+	cases := []struct {
+		patch map[string]string
+		want  string
+	}{
+		// Книга добавлена 01-01-2020, раньше нового года издания
+		{map[string]string{"id": ids[0], "year": "2024"}, codeValidation},
+		{map[string]string{"id": ids[1], "name": "Первая книга"}, codeDuplicate},
+		// Своя пара название+авторы не считается повтором
+		{map[string]string{"id": ids[1], "name": "Вторая книга", "score": "7"}, ""},
+	}
+	for _, c := range cases {
+		resp, err := s.do(map[string]interface{}{"op": "update", "book": c.patch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != c.want {
+			t.Errorf("update %v: %s %s, ожидался код %q", c.patch, resp.Code, resp.Error, c.want)
+		}
+	}
+
+	books, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 2 || books[0].Year != "2000" || books[1].Name != "Вторая книга" {
+		t.Errorf("после отклоненных изменений в базе %+v", books)
+	}
+}
+
+// TestCheckSearchValue checks that the menu search checks a value by the
+// rule of its field
+func TestCheckSearchValue(t *testing.T) {
+	cases := []struct {
+		field, value string
+		ok           bool
+	}{
+		{"id", "12", true},
+		{"id", "1.5", false},
+		{"year", "1999", true},
+		{"year", "девяностые", false},
+		{"width", "120", true},
+		{"width", "120.5", true},
+		{"height", "высокая", false},
+		{"score", "10", true},
+		{"score", "", true},
+		{"score", "11", false},
+		{"name", "что угодно", true},
+	}
+	for _, c := range cases {
+		if err := checkSearchValue(c.field, c.value); (err == nil) != c.ok {
+			t.Errorf("%s=%q: %v", c.field, c.value, err)
+		}
+	}
+}
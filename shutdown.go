@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errShuttingDown is sent to JSON sessions that are closed by a shutdown
+var errShuttingDown = errors.New("сервер завершает работу")
+
+// errIdleTimeout is sent to JSON sessions closed after config.IdleTimeout
+var errIdleTimeout = errors.New("сеанс закрыт из-за бездействия")
+
+// Ошибки, с которыми новое соединение отклоняется
+var (
+	errServerBusy    = errors.New("сервер занят, попробуйте позже")
+	errTooManyFromIP = errors.New("слишком много соединений с вашего адреса, попробуйте позже")
+)
+
+// sessionTracker keeps the open TCP sessions so a shutdown can stop them and
+// wait until the operations they are running have finished. It also enforces
+// config.MaxConnections and config.MaxPerIP
+type sessionTracker struct {
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	perIP   map[string]int
+	wg      sync.WaitGroup
+	closing bool
+}
+
+var sessions = newSessionTracker()
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{conns: make(map[net.Conn]struct{}), perIP: make(map[string]int)}
+}
+
+func hostOf(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// add registers a new session. It fails with errShuttingDown once the
+// shutdown has begun, and with errServerBusy or errTooManyFromIP over the limits
+func (t *sessionTracker) add(conn net.Conn) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	host := hostOf(conn)
+	switch {
+	case t.closing:
+		return errShuttingDown
+	case config.MaxConnections > 0 && len(t.conns) >= config.MaxConnections:
+		return errServerBusy
+	case config.MaxPerIP > 0 && t.perIP[host] >= config.MaxPerIP:
+		return errTooManyFromIP
+	}
+	t.conns[conn] = struct{}{}
+	t.perIP[host]++
+	t.wg.Add(1)
+	log.Printf("Новое соединение: %s, активных соединений: %d", conn.RemoteAddr(), len(t.conns))
+	return nil
+}
+
+func (t *sessionTracker) done(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	host := hostOf(conn)
+	if t.perIP[host]--; t.perIP[host] <= 0 {
+		delete(t.perIP, host)
+	}
+	log.Printf("Активных соединений: %d", len(t.conns))
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// extendDeadline gives the session config.IdleTimeout more to send the next
+// line. It does nothing once drain has set the deadline to stop the session
+func (t *sessionTracker) extendDeadline(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closing && config.IdleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(config.IdleTimeout)))
+	}
+}
+
+// idleReader reads from a session connection, closing it after
+// config.IdleTimeout without input
+type idleReader struct {
+	conn net.Conn
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	sessions.extendDeadline(r.conn)
+	return r.conn.Read(p)
+}
+
+// isTimeout reports whether a read failed because the deadline passed
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// reject tells a client why its connection is refused and closes it
+func reject(conn net.Conn, reason error) {
+	defer conn.Close()
+	log.Printf("Соединение %s отклонено: %v", conn.RemoteAddr(), reason)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(reason.Error() + "\n"))
+}
+
+// shuttingDown reports whether the sessions have been told to stop
+func (t *sessionTracker) shuttingDown() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closing
+}
+
+// drain stops every session at its next read: a session waiting for input
+// ends right away, one in the middle of an operation finishes it first and
+// sends the result. Sessions still running when ctx expires are cut off
+func (t *sessionTracker) drain(ctx context.Context) {
+	t.mu.Lock()
+	t.closing = true
+	log.Printf("Завершение сеансов: %d", len(t.conns))
+	for conn := range t.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	t.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		t.mu.Lock()
+		log.Printf("Не дождались завершения сеансов: %d, соединения закрыты", len(t.conns))
+		for conn := range t.conns {
+			conn.Close()
+		}
+		t.mu.Unlock()
+	}
+}
+
+// shutdown runs after the listener is closed: it drains the TCP sessions and
+// the HTTP API within config.ShutdownTimeout and then waits for the exclusive
+// database lock, so no write is left half-done when the process exits
+func shutdown(httpServer *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout))
+	defer cancel()
+
+	var wg sync.WaitGroup
+	if httpServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := httpServer.Shutdown(ctx); err != nil {
+				log.Printf("Ошибка остановки HTTP API: %v", err)
+			}
+		}()
+	}
+	sessions.drain(ctx)
+	wg.Wait()
+
+	// Запись, начатая до истечения срока, держит блокировку до своего конца
+	unlock, err := lockDB(true)
+	if err != nil {
+		log.Printf("Не удалось дождаться записи в базу: %v", err)
+		return
+	}
+	unlock()
+	log.Printf("Сервер остановлен")
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useSessionTracker gives the test its own sessionTracker, so a shutdown or
+// the connection limits don't reach the other tests
+func useSessionTracker(t *testing.T) *sessionTracker {
+	t.Helper()
+	saved := sessions
+	t.Cleanup(func() { sessions = saved })
+	sessions = newSessionTracker()
+	return sessions
+}
+
+// logWatch is a log output that closes seen once a line contains want
+type logWatch struct {
+	mu   sync.Mutex
+	want string
+	seen chan struct{}
+}
+
+func (w *logWatch) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.want != "" && strings.Contains(string(p), w.want) {
+		w.want = ""
+		close(w.seen)
+	}
+	return len(p), nil
+}
+
+// readResponse reads the next JSON response of a session
+func readResponse(t *testing.T, s *jsonSession) testResponse {
+	t.Helper()
+	var resp testResponse
+	line, err := s.reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("ответ не получен: %v", err)
+	}
+	if err := json.Unmarshal(line, &resp); err != nil {
+		t.Fatalf("ответ %q: %v", line, err)
+	}
+	return resp
+}
+
+// TestGracefulShutdown starts a shutdown while a create waits for the
+// database: an idle session is told about the shutdown right away, new
+// connections are refused, and the create is finished and answered before
+// its session is closed
+func TestGracefulShutdown(t *testing.T) {
+	useSessionTracker(t)
+	addr := startTestServer(t, true)
+	busy, err := dialJSON(addr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.conn.Close()
+	idle, err := dialJSON(addr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.conn.Close()
+
+	unlock, err := lockDB(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	released := false
+	defer func() {
+		if !released {
+			unlock()
+		}
+	}()
+
+	// Сервер пишет запрос в журнал, прочитав его, и только потом ждет базу
+	watch := &logWatch{want: "Книга при остановке", seen: make(chan struct{})}
+	log.SetOutput(watch)
+	request, _ := json.Marshal(map[string]interface{}{"op": "create", "book": testBook("Книга при остановке")})
+	if _, err := busy.conn.Write(append(request, '\n')); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-watch.seen:
+	case <-time.After(10 * time.Second):
+		t.Fatal("сервер не прочитал запрос")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		shutdown(nil)
+		close(stopped)
+	}()
+
+	if resp := readResponse(t, idle); resp.Code != codeShutdown {
+		t.Errorf("ожидающий сеанс получил %+v, ожидался код %s", resp, codeShutdown)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if strings.TrimSpace(line) != errShuttingDown.Error() {
+		t.Errorf("новое соединение получило %q", line)
+	}
+
+	select {
+	case <-stopped:
+		t.Fatal("сервер остановился, не дождавшись записи")
+	default:
+	}
+	unlock()
+	released = true
+
+	if resp := readResponse(t, busy); resp.Status != "ok" {
+		t.Errorf("добавление во время остановки: %s %s", resp.Code, resp.Error)
+	}
+	if resp := readResponse(t, busy); resp.Code != codeShutdown {
+		t.Errorf("после добавления сеанс получил %+v, ожидался код %s", resp, codeShutdown)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("сервер не остановился")
+	}
+
+	books, err := Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 1 || books[0].Name != "Книга при остановке" {
+		t.Errorf("после остановки в базе %+v", books)
+	}
+}
+
+// addrConn is a connection that only has a remote address, enough for
+// sessionTracker.add and done
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+func connFrom(host string, port int) net.Conn {
+	return addrConn{addr: &net.TCPAddr{IP: net.ParseIP(host), Port: port}}
+}
+
+// TestSessionLimits checks that add refuses sessions over max_connections
+// and max_per_ip, and that a finished session frees its place
+func TestSessionLimits(t *testing.T) {
+	silenceLog(t)
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	cases := []struct {
+		name            string
+		maxConns, perIP int
+		hosts           []string
+		want            error // ошибка последнего соединения
+	}{
+		{"без ограничений", 0, 0, []string{"10.0.0.1", "10.0.0.1", "10.0.0.1"}, nil},
+		{"в пределах", 3, 2, []string{"10.0.0.1", "10.0.0.2", "10.0.0.1"}, nil},
+		{"больше max_connections", 2, 0, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, errServerBusy},
+		{"больше max_per_ip", 0, 2, []string{"10.0.0.1", "10.0.0.1", "10.0.0.1"}, errTooManyFromIP},
+		{"max_connections раньше max_per_ip", 2, 1, []string{"10.0.0.1", "10.0.0.2", "10.0.0.1"}, errServerBusy},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tracker := newSessionTracker()
+			config.MaxConnections, config.MaxPerIP = c.maxConns, c.perIP
+
+			var conns []net.Conn
+			for i, host := range c.hosts[:len(c.hosts)-1] {
+				conn := connFrom(host, 1000+i)
+				if err := tracker.add(conn); err != nil {
+					t.Fatalf("соединение %d с %s: %v", i+1, host, err)
+				}
+				conns = append(conns, conn)
+			}
+			last := connFrom(c.hosts[len(c.hosts)-1], 2000)
+			if err := tracker.add(last); err != c.want {
+				t.Fatalf("последнее соединение: %v, ожидалось %v", err, c.want)
+			}
+			if c.want == nil {
+				return
+			}
+
+			// Первый сеанс в каждом случае идет с адреса последнего, и его
+			// завершение освобождает место под оба ограничения
+			tracker.done(conns[0])
+			if err := tracker.add(last); err != nil {
+				t.Errorf("после завершения сеанса: %v", err)
+			}
+		})
+	}
+}
+
+// TestIdleTimeout checks that a session that sends nothing for idle_timeout
+// is told so and closed, in the menu and in the JSON mode
+func TestIdleTimeout(t *testing.T) {
+	useSessionTracker(t)
+	useTestDatabase(t)
+	config.IdleTimeout = duration(200 * time.Millisecond)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveClients(t, listener)
+	addr := listener.Addr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var lines []string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("сеанс меню не закрыт: %v", err)
+	}
+	if len(lines) == 0 || lines[len(lines)-1] != "Сеанс закрыт из-за бездействия" {
+		t.Errorf("последняя строка меню: %q", lines)
+	}
+
+	s, err := dialJSON(addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.conn.Close()
+	if resp := readResponse(t, s); resp.Code != codeTimeout {
+		t.Errorf("JSON-сеанс получил %+v, ожидался код %s", resp, codeTimeout)
+	}
+}
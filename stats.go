@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// libraryStats is a summary of the catalogue. Authors and genres are counted
+// per entry of their comma-separated lists, without regard to case
+type libraryStats struct {
+	Total      int            `json:"total"`
+	Unread     int            `json:"unread"`
+	ByGenre    map[string]int `json:"by_genre"`
+	ByAuthor   map[string]int `json:"by_author"`
+	BySource   map[string]int `json:"by_source"`
+	ByCover    map[string]int `json:"by_cover"`
+	ReadByYear map[string]int `json:"read_by_year"`
+	Rated      int            `json:"rated"`
+	// AverageScore and AverageDaysToRead are nil when there is nothing to average
+	AverageScore      *float64 `json:"average_score"`
+	AverageDaysToRead *float64 `json:"average_days_to_read"`
+}
+
+// libraryStatistics computes the statistics from the books Read returns
+func libraryStatistics() (libraryStats, error) {
+	books, err := Read()
+	if err != nil {
+		return libraryStats{}, err
+	}
+	return computeStats(books), nil
+}
+
+func computeStats(books []Book) libraryStats {
+	stats := libraryStats{
+		Total:      len(books),
+		ByGenre:    make(map[string]int),
+		ByAuthor:   make(map[string]int),
+		BySource:   make(map[string]int),
+		ByCover:    make(map[string]int),
+		ReadByYear: make(map[string]int),
+	}
+
+	var scoreSum, daysSum float64
+	var timed int
+	genres, authors := make(map[string]string), make(map[string]string)
+	for _, book := range books {
+		countEntries(stats.ByGenre, genres, book.Genres)
+		countEntries(stats.ByAuthor, authors, book.Authors)
+		if book.Source != "" {
+			stats.BySource[book.Source]++
+		}
+		if book.Cover != "" {
+			stats.ByCover[book.Cover]++
+		}
+
+		if score, err := strconv.Atoi(book.Score); err == nil {
+			scoreSum += float64(score)
+			stats.Rated++
+		}
+
+		read, err := time.Parse(dateLayout, book.Read)
+		if err != nil {
+			stats.Unread++
+			continue
+		}
+		stats.ReadByYear[strconv.Itoa(read.Year())]++
+		if added, err := time.Parse(dateLayout, book.Added); err == nil {
+			daysSum += read.Sub(added).Hours() / 24
+			timed++
+		}
+	}
+
+	if stats.Rated > 0 {
+		average := scoreSum / float64(stats.Rated)
+		stats.AverageScore = &average
+	}
+	if timed > 0 {
+		average := daysSum / float64(timed)
+		stats.AverageDaysToRead = &average
+	}
+	return stats
+}
+
+// countEntries counts every entry of a comma-separated list under the
+// spelling it was first seen with (spellings maps lower case to it)
+func countEntries(counts map[string]int, spellings map[string]string, list string) {
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		key := strings.ToLower(entry)
+		if entry == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if _, ok := spellings[key]; !ok {
+			spellings[key] = entry
+		}
+		counts[spellings[key]]++
+	}
+}
+
+func formatStats(stats libraryStats) string {
+	var builder strings.Builder
+	builder.WriteString("\nСтатистика библиотеки:\n")
+	builder.WriteString(strings.Repeat("-", 50) + "\n")
+	builder.WriteString(fmt.Sprintf("Всего книг: %d\n", stats.Total))
+	builder.WriteString(fmt.Sprintf("Не прочитано: %d\n", stats.Unread))
+	if stats.AverageScore != nil {
+		builder.WriteString(fmt.Sprintf("Средняя оценка: %.1f (оценено книг: %d)\n", *stats.AverageScore, stats.Rated))
+	} else {
+		builder.WriteString("Средняя оценка: нет оценок\n")
+	}
+	if stats.AverageDaysToRead != nil {
+		builder.WriteString(fmt.Sprintf("Среднее время от добавления до прочтения: %.1f дн.\n", *stats.AverageDaysToRead))
+	}
+
+	writeCounts(&builder, "Прочитано по годам", stats.ReadByYear, true)
+	writeCounts(&builder, "По жанрам", stats.ByGenre, false)
+	writeCounts(&builder, "По авторам", stats.ByAuthor, false)
+	writeCounts(&builder, "По источникам", stats.BySource, false)
+	writeCounts(&builder, "По типу обложки", stats.ByCover, false)
+	builder.WriteString(strings.Repeat("-", 50) + "\n")
+	return builder.String()
+}
+
+// writeCounts lists counts by key (byKey) or from the largest count down
+func writeCounts(builder *strings.Builder, title string, counts map[string]int, byKey bool) {
+	if len(counts) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !byKey && counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	builder.WriteString(title + ":\n")
+	for _, key := range keys {
+		builder.WriteString(fmt.Sprintf("  %s: %d\n", key, counts[key]))
+	}
+}
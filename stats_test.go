@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// statsBook is newTestBook with the fields the statistics look at
+func statsBook(id, authors, genres, score, added, read string) Book {
+	book := newTestBook("Книга " + id)
+	book.ID, book.Authors, book.Genres = id, authors, genres
+	book.Score, book.Added, book.Read = score, added, read
+	return book
+}
+
+// TestLibraryStatistics checks the statistics of a stored catalogue: authors
+// and genres are counted per list entry, averages skip unrated and unread books
+func TestLibraryStatistics(t *testing.T) {
+	cases := []struct {
+		name      string
+		books     []Book
+		want      libraryStats
+		wantScore float64 // -1: нет средней оценки
+		wantDays  float64 // -1: нет среднего срока
+	}{
+		{
+			name:      "пустая база",
+			want:      libraryStats{ByGenre: map[string]int{}, ByAuthor: map[string]int{}, ReadByYear: map[string]int{}},
+			wantScore: -1,
+			wantDays:  -1,
+		},
+		{
+			name: "списки через запятую",
+			books: []Book{
+				statsBook("1", "Ильф, Петров", "Роман, Сатира", "", "01-01-2020", ""),
+				statsBook("2", "Петров", "сатира", "", "01-01-2020", ""),
+				statsBook("3", "Ильф, ильф", "Роман", "", "01-01-2020", ""),
+			},
+			want: libraryStats{
+				Total:      3,
+				Unread:     3,
+				ByGenre:    map[string]int{"Роман": 2, "Сатира": 2},
+				ByAuthor:   map[string]int{"Ильф": 2, "Петров": 2},
+				ReadByYear: map[string]int{},
+			},
+			wantScore: -1,
+			wantDays:  -1,
+		},
+		{
+			name: "оценки и сроки чтения",
+			books: []Book{
+				statsBook("1", "Автор", "Роман", "8", "01-01-2020", "11-01-2020"),
+				statsBook("2", "Автор", "Роман", "", "01-06-2020", "31-12-2021"),
+				statsBook("3", "Автор", "Роман", "5", "01-01-2021", "21-01-2021"),
+				statsBook("4", "Автор", "Роман", "10", "01-01-2022", ""),
+			},
+			want: libraryStats{
+				Total:      4,
+				Unread:     1,
+				ByGenre:    map[string]int{"Роман": 4},
+				ByAuthor:   map[string]int{"Автор": 4},
+				ReadByYear: map[string]int{"2020": 1, "2021": 2},
+				Rated:      3,
+			},
+			wantScore: 23.0 / 3,
+			wantDays:  (10 + 578 + 20) / 3.0,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useMemoryDatabase(t, c.books...)
+			got, err := libraryStatistics()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkAverage(t, "средняя оценка", got.AverageScore, c.wantScore)
+			checkAverage(t, "средний срок", got.AverageDaysToRead, c.wantDays)
+			got.AverageScore, got.AverageDaysToRead = nil, nil
+			// Источник и обложка у всех книг одинаковые
+			got.BySource, got.ByCover = nil, nil
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("статистика:\n%+v\nожидалась\n%+v", got, c.want)
+			}
+		})
+	}
+}
+
+func checkAverage(t *testing.T, name string, got *float64, want float64) {
+	t.Helper()
+	switch {
+	case want < 0 && got != nil:
+		t.Errorf("%s: %v, ожидалось отсутствие", name, *got)
+	case want >= 0 && got == nil:
+		t.Errorf("%s отсутствует, ожидалось %v", name, want)
+	case want >= 0 && (*got-want > 1e-9 || want-*got > 1e-9):
+		t.Errorf("%s: %v, ожидалось %v", name, *got, want)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+// Store persists book records. Implementations don't validate books or
+// allocate IDs: that stays in createBook and the Validate* functions
+type Store interface {
+	// Get returns the book with the given ID or errBookNotFound
+	Get(id string) (Book, error)
+	// List returns every book in storage order
+	List() ([]Book, error)
+	// Insert adds a new book at the end of the storage
+	Insert(book Book) error
+	// Replace overwrites the book with the same ID or returns errBookNotFound
+	Replace(book Book) error
+	// Remove deletes the books with the given IDs and returns them,
+	// or errBookNotFound if none of them exist
+	Remove(ids []string) ([]Book, error)
+	// ReplaceAll replaces every book in storage with books, in that order
+	ReplaceAll(books []Book) error
+	// Scan calls fn for every book in storage order until fn returns false
+	Scan(fn func(Book) bool) error
+	// NextID allocates an ID that has never been used in this store
+	NextID() (int, error)
+}
+
+// recoverable is implemented by stores that have to repair themselves
+// after a crash before serving requests
+type recoverable interface {
+	Recover() error
+}
+
+// indexed is implemented by stores that find books by field value and by
+// name and authors without reading every book
+type indexed interface {
+	// Lookup returns the books that findBooks would find for field and
+	// value; ok is false if the store can't answer without a full scan
+	Lookup(field, value string, exact bool) (books []Book, ok bool, err error)
+	// FindByTitle returns the ID of the book with exactly this name and authors
+	FindByTitle(name, authors string) (id string, found bool, err error)
+}
+
+// sequenced is implemented by stores whose ID sequence can be saved in a
+// dump and moved forward when one is restored
+type sequenced interface {
+	// LastID returns the last allocated ID
+	LastID() (int, error)
+	// AdvanceID makes sure no ID up to last is allocated again
+	AdvanceID(last int) error
+}
+
+// store is the backend used by Create, Read, Update and the other operations
+var store Store = newFileStore(FILENAME, tempFilename)
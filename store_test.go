@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// useMemoryDatabase puts books in a memoryStore and the history, trash and
+// users files in a temporary directory until the test ends, and silences the log
+func useMemoryDatabase(t *testing.T, books ...Book) *memoryStore {
+	t.Helper()
+	silenceLog(t)
+	savedStore, savedHistory, savedTrash, savedUsers := store, history, trash, usersPath
+	t.Cleanup(func() {
+		store, history, trash, usersPath = savedStore, savedHistory, savedTrash, savedUsers
+	})
+
+	s := newMemoryStore(books...)
+	store = s
+	path := filepath.Join(t.TempDir(), "books")
+	useDataFiles(path, path+".users")
+	return s
+}
+
+// newTempFileStore returns a fileStore over a books file in a temporary
+// directory and the path of that file
+func newTempFileStore(t *testing.T) (*fileStore, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "books")
+	return newFileStore(path, filepath.Join(dir, "books.tmp")), path
+}
+
+// TestStoresAgree runs the same operations against both Store
+// implementations and compares what they return
+func TestStoresAgree(t *testing.T) {
+	fs, _ := newTempFileStore(t)
+	stores := map[string]Store{
+		"file":   fs,
+		"memory": newMemoryStore(),
+	}
+
+	results := make(map[string][]Book)
+	for name, s := range stores {
+		for i := 1; i <= 3; i++ {
+			id, err := s.NextID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			book := newTestBook(fmt.Sprintf("Книга %d", i))
+			book.ID = fmt.Sprint(id)
+			if err := s.Insert(book); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+
+		changed, err := s.Get("2")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		changed.Score = "9"
+		if err := s.Replace(changed); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := s.Replace(Book{ID: "42"}); !errors.Is(err, errBookNotFound) {
+			t.Errorf("%s: замена несуществующей книги: %v", name, err)
+		}
+		if removed, err := s.Remove([]string{"1", "42"}); err != nil || len(removed) != 1 {
+			t.Errorf("%s: удаление: %+v, %v", name, removed, err)
+		}
+		if _, err := s.Remove([]string{"1"}); !errors.Is(err, errBookNotFound) {
+			t.Errorf("%s: повторное удаление: %v", name, err)
+		}
+		if _, err := s.Get("1"); !errors.Is(err, errBookNotFound) {
+			t.Errorf("%s: удаленная книга: %v", name, err)
+		}
+		// ID удаленной книги не выдается повторно
+		if id, err := s.NextID(); err != nil || id != 4 {
+			t.Errorf("%s: следующий ID %d, %v, ожидался 4", name, id, err)
+		}
+
+		books, err := s.List()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		results[name] = books
+	}
+
+	if !reflect.DeepEqual(results["file"], results["memory"]) {
+		t.Errorf("хранилища разошлись:\nфайл   %+v\nпамять %+v", results["file"], results["memory"])
+	}
+	if len(results["memory"]) != 2 || results["memory"][0].Score != "9" {
+		t.Errorf("после изменений: %+v", results["memory"])
+	}
+}
@@ -0,0 +1,119 @@
+//go:build ignore
+
+// gen writes the certificates of the TLS tests to this directory:
+// books-ca with a server certificate for 127.0.0.1 and localhost and a client
+// certificate, and other-ca with a client certificate (stranger) that
+// books-ca doesn't trust. Run it from the repository root:
+//
+//	go run testdata/pki/gen.go
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const dir = "testdata/pki"
+
+// Сертификаты лежат в репозитории, поэтому выдаются на сто лет
+var notBefore = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+var notAfter = notBefore.AddDate(100, 0, 0)
+
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func main() {
+	ca := newCA("books-ca")
+	ca.issue("server", true)
+	ca.issue("client", false)
+	other := newCA("other-ca")
+	other.issue("stranger", false)
+}
+
+func newCA(name string) authority {
+	key := generateKey()
+	template := &x509.Certificate{
+		SerialNumber:          newSerial(),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writePEM(name+".pem", "CERTIFICATE", der)
+	return authority{cert: cert, key: key}
+}
+
+// issue signs a certificate for name, for a server on 127.0.0.1 and
+// localhost or for a client, and writes it to name.pem and name.key
+func (ca authority) issue(name string, server bool) {
+	key := generateKey()
+	template := &x509.Certificate{
+		SerialNumber: newSerial(),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		template.DNSNames = []string{"localhost"}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writePEM(name+".pem", "CERTIFICATE", der)
+	writePEM(name+".key", "EC PRIVATE KEY", keyDER)
+}
+
+func generateKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// newSerial returns a random 128-bit certificate serial number
+func newSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return serial
+}
+
+func writePEM(name, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Настройки TLS; пока не заданы сертификат и ключ, сервер работает без шифрования
+var (
+	tlsCertFile string
+	tlsKeyFile  string
+	// tlsClientCA is a PEM bundle of CAs; when set, every client has to present
+	// a certificate signed by one of them
+	tlsClientCA string
+)
+
+// serverTLSConfig builds the TLS configuration from the flags, or returns nil
+// when TLS is off
+func serverTLSConfig() (*tls.Config, error) {
+	if tlsCertFile == "" && tlsKeyFile == "" {
+		if tlsClientCA != "" {
+			return nil, fmt.Errorf("для проверки клиентских сертификатов нужны -tls-cert и -tls-key")
+		}
+		return nil, nil
+	}
+	if tlsCertFile == "" || tlsKeyFile == "" {
+		return nil, fmt.Errorf("нужно указать и -tls-cert, и -tls-key")
+	}
+
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка загрузки сертификата: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if tlsClientCA != "" {
+		pool, err := loadCertPool(tlsClientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения сертификатов CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("в %s нет сертификатов в формате PEM", path)
+	}
+	return pool, nil
+}
+
+// listen opens the TCP listener, wrapped in TLS when config is not nil
+func listen(address string, config *tls.Config) (net.Listener, error) {
+	if config == nil {
+		return net.Listen("tcp", address)
+	}
+	return tls.Listen("tcp", address, config)
+}
+
+// peerName describes the client certificate of a TLS connection for the log,
+// or returns "" for a plain connection or one without a certificate. The
+// handshake happens here rather than on the first read, so a client with a
+// bad certificate is turned away before anything is sent to it
+func peerName(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", fmt.Errorf("ошибка TLS: %v", err)
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return "", nil
+	}
+	return state.PeerCertificates[0].Subject.CommonName, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pkiFile returns the path of a certificate or key generated for the TLS
+// tests by testdata/pki/gen.go
+func pkiFile(name string) string {
+	return filepath.Join("testdata", "pki", name)
+}
+
+// startTLSServer serves handleClient over TLS with the given server
+// certificate and, if clientCA is not empty, required client certificates
+func startTLSServer(t *testing.T, certPath, keyPath, clientCA string) string {
+	t.Helper()
+	useTestDatabase(t)
+	savedCert, savedKey, savedCA := tlsCertFile, tlsKeyFile, tlsClientCA
+	t.Cleanup(func() { tlsCertFile, tlsKeyFile, tlsClientCA = savedCert, savedKey, savedCA })
+	tlsCertFile, tlsKeyFile, tlsClientCA = certPath, keyPath, clientCA
+
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := listen("127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveClients(t, listener)
+	return listener.Addr().String()
+}
+
+// clientConfig trusts the CA in caPath and presents the given client
+// certificate, if any
+func clientConfig(t *testing.T, caPath, certPath, keyPath string) *tls.Config {
+	t.Helper()
+	pool, err := loadCertPool(caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	if certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config
+}
+
+// greet connects and returns the first line the server sends. With TLS 1.3
+// a refused client certificate only shows up on that first read
+func greet(addr string, config *tls.Config) (string, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	return strings.TrimSpace(line), err
+}
+
+const greeting = "Вы подключились к серверу!"
+
+func TestTLSClientCertificates(t *testing.T) {
+	ca, otherCA := pkiFile("books-ca.pem"), pkiFile("other-ca.pem")
+	serverCert, serverKey := pkiFile("server.pem"), pkiFile("server.key")
+	clientCert, clientKey := pkiFile("client.pem"), pkiFile("client.key")
+	strangerCert, strangerKey := pkiFile("stranger.pem"), pkiFile("stranger.key")
+
+	addr := startTLSServer(t, serverCert, serverKey, ca)
+
+	if line, err := greet(addr, clientConfig(t, ca, clientCert, clientKey)); err != nil || line != greeting {
+		t.Errorf("клиент с сертификатом: %q, %v", line, err)
+	}
+	if line, err := greet(addr, clientConfig(t, ca, "", "")); err == nil {
+		t.Errorf("клиент без сертификата принят: %q", line)
+	}
+	if line, err := greet(addr, clientConfig(t, ca, strangerCert, strangerKey)); err == nil {
+		t.Errorf("клиент с сертификатом чужого CA принят: %q", line)
+	}
+	if line, err := greet(addr, clientConfig(t, otherCA, clientCert, clientKey)); err == nil {
+		t.Errorf("клиент принял сертификат сервера от чужого CA: %q", line)
+	}
+}
+
+func TestTLSWithoutClientCA(t *testing.T) {
+	ca := pkiFile("books-ca.pem")
+	addr := startTLSServer(t, pkiFile("server.pem"), pkiFile("server.key"), "")
+
+	if line, err := greet(addr, clientConfig(t, ca, "", "")); err != nil || line != greeting {
+		t.Errorf("клиент без сертификата: %q, %v", line, err)
+	}
+}
+
+func TestServerTLSConfigErrors(t *testing.T) {
+	savedCert, savedKey, savedCA := tlsCertFile, tlsKeyFile, tlsClientCA
+	t.Cleanup(func() { tlsCertFile, tlsKeyFile, tlsClientCA = savedCert, savedKey, savedCA })
+
+	serverCert, serverKey := pkiFile("server.pem"), pkiFile("server.key")
+	cases := []struct{ cert, key, clientCA string }{
+		{"", "", pkiFile("books-ca.pem")},
+		{serverCert, "", ""},
+		{serverCert, serverKey, filepath.Join(t.TempDir(), "missing.pem")},
+		{serverCert, serverKey, serverKey},
+	}
+	for _, c := range cases {
+		tlsCertFile, tlsKeyFile, tlsClientCA = c.cert, c.key, c.clientCA
+		if _, err := serverTLSConfig(); err == nil {
+			t.Errorf("настройки %+v приняты", c)
+		}
+	}
+}
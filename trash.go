@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// trashEntry is a deleted book together with when and by whom it was deleted
+type trashEntry struct {
+	Book      Book      `json:"book"`
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy string    `json:"deleted_by"`
+}
+
+// trashBin keeps deleted books as JSON lines until they are restored or
+// purged. It is only touched under the exclusive database lock
+type trashBin struct {
+	path string
+}
+
+var trash = &trashBin{path: FILENAME + ".trash"}
+
+// trashRetention is how long deleted books stay in the trash; 0 keeps them
+// until they are purged by hand
+var trashRetention time.Duration
+
+var errNotInTrash = errors.New("книга не найдена в корзине")
+
+func (t *trashBin) load() ([]trashEntry, error) {
+	file, err := os.Open(t.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия корзины: %v", err)
+	}
+	defer file.Close()
+
+	var entries []trashEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry trashEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("ошибка чтения корзины: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка чтения корзины: %v", err)
+	}
+	return entries, nil
+}
+
+// save replaces the trash file atomically
+func (t *trashBin) save(entries []trashEntry) error {
+	tempPath := t.path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("ошибка записи корзины: %v", err)
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range entries {
+		if err = encoder.Encode(entry); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("ошибка записи корзины: %v", err)
+	}
+	if err := os.Rename(tempPath, t.path); err != nil {
+		return fmt.Errorf("ошибка записи корзины: %v", err)
+	}
+	return nil
+}
+
+// deleteBooks moves the books with the given IDs to the trash; an ID given
+// twice is trashed once. The books are put in the trash before they are
+// removed, so a crash in between leaves a copy in both places rather than in
+// neither
+func deleteBooks(ids []string, client string) ([]Book, error) {
+	unlock, err := lockDB(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries, err := trash.load()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var found []string
+	for _, id := range ids {
+		if contains(found, id) {
+			continue
+		}
+		book, err := store.Get(id)
+		if errors.Is(err, errBookNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, trashEntry{Book: book, DeletedAt: now, DeletedBy: client})
+		found = append(found, id)
+	}
+	if len(found) == 0 {
+		return nil, errBookNotFound
+	}
+	if err := trash.save(entries); err != nil {
+		return nil, err
+	}
+
+	removed, err := store.Remove(found)
+	if err != nil {
+		return nil, err
+	}
+	for _, book := range removed {
+		recordChange(historyDelete, &book, nil, client)
+		log.Printf("Книга %s (ID: %s) перемещена в корзину клиентом %s", book.Name, book.ID, client)
+	}
+	return removed, nil
+}
+
+// listTrash returns the trash, oldest deletion first
+func listTrash() ([]trashEntry, error) {
+	unlock, err := lockDB(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return trash.load()
+}
+
+// restoreFromTrash puts a deleted book back under its old ID. It fails with
+// errBookExists if a book with the same name and authors was added since
+func restoreFromTrash(id, client string) (Book, error) {
+	unlock, err := lockDB(true)
+	if err != nil {
+		return Book{}, err
+	}
+	defer unlock()
+
+	entries, err := trash.load()
+	if err != nil {
+		return Book{}, err
+	}
+	// Если книгу удаляли несколько раз, восстанавливается последняя копия
+	index := -1
+	for i, entry := range entries {
+		if entry.Book.ID == id {
+			index = i
+		}
+	}
+	if index < 0 {
+		return Book{}, errNotInTrash
+	}
+	book := entries[index].Book
+
+	if _, err := store.Get(id); err == nil {
+		return Book{}, errBookExists
+	} else if !errors.Is(err, errBookNotFound) {
+		return Book{}, err
+	}
+	if unique, err := isUniqueBook(book); err != nil {
+		return Book{}, err
+	} else if !unique {
+		return Book{}, errBookExists
+	}
+
+	if err := store.Insert(book); err != nil {
+		return Book{}, err
+	}
+	if err := trash.save(append(entries[:index:index], entries[index+1:]...)); err != nil {
+		return Book{}, err
+	}
+	recordChange(historyRestore, nil, &book, client)
+	log.Printf("Книга %s (ID: %s) восстановлена из корзины клиентом %s", book.Name, book.ID, client)
+	return book, nil
+}
+
+// purgeTrash deletes books from the trash for good: those with the given
+// IDs, or every book if ids is empty. It returns the purged entries
+func purgeTrash(ids []string) ([]trashEntry, error) {
+	return dropFromTrash(func(entry trashEntry) bool {
+		return len(ids) == 0 || contains(ids, entry.Book.ID)
+	})
+}
+
+// purgeExpiredTrash deletes books that have been in the trash longer than
+// trashRetention
+func purgeExpiredTrash() ([]trashEntry, error) {
+	if trashRetention <= 0 {
+		return nil, nil
+	}
+	deadline := time.Now().Add(-trashRetention)
+	return dropFromTrash(func(entry trashEntry) bool {
+		return entry.DeletedAt.Before(deadline)
+	})
+}
+
+func dropFromTrash(drop func(trashEntry) bool) ([]trashEntry, error) {
+	unlock, err := lockDB(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries, err := trash.load()
+	if err != nil {
+		return nil, err
+	}
+	var kept, dropped []trashEntry
+	for _, entry := range entries {
+		if drop(entry) {
+			dropped = append(dropped, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	if len(dropped) == 0 {
+		return nil, nil
+	}
+	if err := trash.save(kept); err != nil {
+		return nil, err
+	}
+	return dropped, nil
+}
+
+// purgeTrashPeriodically applies trashRetention once an hour
+func purgeTrashPeriodically() {
+	for {
+		if purged, err := purgeExpiredTrash(); err != nil {
+			log.Printf("Ошибка очистки корзины: %v", err)
+		} else if len(purged) > 0 {
+			log.Printf("Из корзины удалено книг с истекшим сроком хранения: %d", len(purged))
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func formatTrash(entries []trashEntry) string {
+	if len(entries) == 0 {
+		return "Корзина пуста"
+	}
+	var builder strings.Builder
+	builder.WriteString("\nКорзина:\n")
+	builder.WriteString(strings.Repeat("-", 50) + "\n")
+	for _, entry := range entries {
+		builder.WriteString(fmt.Sprintf("ID: %s, Название: %s, Авторы: %s\nУдалена: %s, клиент: %s\n",
+			entry.Book.ID, entry.Book.Name, entry.Book.Authors,
+			entry.DeletedAt.Format("02-01-2006 15:04:05"), entry.DeletedBy))
+		builder.WriteString(strings.Repeat("-", 50) + "\n")
+	}
+	return builder.String()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestTrashDeleteRestorePurge moves books to the trash, with one ID given
+// twice, then restores one and purges the other
+func TestTrashDeleteRestorePurge(t *testing.T) {
+	useMemoryDatabase(t)
+
+	var ids []string
+	for _, name := range []string{"Первая книга", "Вторая книга"} {
+		book, err := createBook(newTestBook(name), "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, book.ID)
+	}
+
+	deleted, err := deleteBooks([]string{ids[0], ids[1], ids[0]}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("удалено книг: %d, ожидалось 2", len(deleted))
+	}
+	entries, err := listTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("в корзине %d записей, ожидалось 2: %+v", len(entries), entries)
+	}
+	if entries[0].DeletedBy != "test" || time.Since(entries[0].DeletedAt) > time.Minute {
+		t.Errorf("запись корзины без клиента или времени удаления: %+v", entries[0])
+	}
+	if books, _ := store.List(); len(books) != 0 {
+		t.Errorf("после удаления в базе остались книги: %+v", books)
+	}
+
+	restored, err := restoreFromTrash(ids[0], "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.ID != ids[0] || restored.Name != "Первая книга" {
+		t.Errorf("восстановлена %+v", restored)
+	}
+	if _, err := restoreFromTrash(ids[0], "test"); !errors.Is(err, errNotInTrash) {
+		t.Errorf("повторное восстановление: %v, ожидалось %v", err, errNotInTrash)
+	}
+
+	purged, err := purgeTrash([]string{ids[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged[0].Book.ID != ids[1] {
+		t.Errorf("удалено из корзины: %+v", purged)
+	}
+	if entries, err := listTrash(); err != nil || len(entries) != 0 {
+		t.Errorf("корзина после восстановления и очистки: %+v, %v", entries, err)
+	}
+	if books, _ := store.List(); len(books) != 1 || books[0].ID != ids[0] {
+		t.Errorf("в базе %+v, ожидалась только восстановленная книга", books)
+	}
+}
+
+// TestRestoreRefusesDuplicateTitle checks that a book isn't restored while a
+// book with the same name and authors has been added since it was deleted
+func TestRestoreRefusesDuplicateTitle(t *testing.T) {
+	useMemoryDatabase(t)
+
+	book, err := createBook(newTestBook("Книга"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deleteBooks([]string{book.ID}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createBook(newTestBook("Книга"), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restoreFromTrash(book.ID, "test"); !errors.Is(err, errBookExists) {
+		t.Errorf("восстановление повторяющейся книги: %v, ожидалось %v", err, errBookExists)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// account is one line of the credentials file:
+// имя:роль:pbkdf2-sha256:итерации:соль:хеш (соль и хеш в hex)
+type account struct {
+	Name       string
+	Role       role
+	Iterations int
+	Salt       []byte
+	Hash       []byte
+}
+
+const (
+	hashScheme     = "pbkdf2-sha256"
+	hashIterations = 210000
+	saltSize       = 16
+	maxLoginTries  = 3
+)
+
+// usersPath is the credentials file; while it has no accounts the server
+// works without a login step
+var usersPath = FILENAME + ".users"
+
+var validUserName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+var (
+	errBadCredentials = errors.New("неверное имя пользователя или пароль")
+	errUserExists     = errors.New("пользователь уже существует")
+	errUserNotFound   = errors.New("пользователь не найден")
+)
+
+// dummyAccount is checked against when the name is unknown, so a wrong name
+// takes as long as a wrong password
+var dummyAccount = account{Iterations: hashIterations, Salt: make([]byte, saltSize), Hash: make([]byte, sha256.Size)}
+
+func hashPassword(password string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+}
+
+func newAccount(name, password string, r role) (account, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return account{}, fmt.Errorf("ошибка генерации соли: %v", err)
+	}
+	hash, err := hashPassword(password, salt, hashIterations)
+	if err != nil {
+		return account{}, fmt.Errorf("ошибка вычисления хеша: %v", err)
+	}
+	return account{Name: name, Role: r, Iterations: hashIterations, Salt: salt, Hash: hash}, nil
+}
+
+func (a account) matches(password string) bool {
+	hash, err := hashPassword(password, a.Salt, a.Iterations)
+	return err == nil && subtle.ConstantTimeCompare(hash, a.Hash) == 1
+}
+
+func (a account) String() string {
+	return strings.Join([]string{a.Name, a.Role.String(), hashScheme, strconv.Itoa(a.Iterations),
+		hex.EncodeToString(a.Salt), hex.EncodeToString(a.Hash)}, ":")
+}
+
+// parseAccount reads an account line. Lines written before roles were added
+// have no role field and get roleReader
+func parseAccount(line string) (account, error) {
+	parts := strings.Split(line, ":")
+	acc := account{Role: roleReader}
+	if len(parts) == 6 {
+		var err error
+		if acc.Role, err = parseRole(parts[1]); err != nil {
+			return account{}, err
+		}
+		parts = append(parts[:1], parts[2:]...)
+	}
+	if len(parts) != 5 || parts[1] != hashScheme {
+		return account{}, fmt.Errorf("ожидается имя:роль:%s:итерации:соль:хеш", hashScheme)
+	}
+	acc.Name = parts[0]
+	iterations, err := strconv.Atoi(parts[2])
+	if err != nil || iterations <= 0 {
+		return account{}, fmt.Errorf("неверное число итераций %q", parts[2])
+	}
+	salt, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return account{}, fmt.Errorf("неверная соль: %v", err)
+	}
+	hash, err := hex.DecodeString(parts[4])
+	if err != nil {
+		return account{}, fmt.Errorf("неверный хеш: %v", err)
+	}
+	acc.Iterations, acc.Salt, acc.Hash = iterations, salt, hash
+	return acc, nil
+}
+
+// loadAccounts reads the credentials file; a missing file has no accounts
+func loadAccounts() (map[string]account, error) {
+	accounts := make(map[string]account)
+	file, err := os.Open(usersPath)
+	if os.IsNotExist(err) {
+		return accounts, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия файла пользователей: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		acc, err := parseAccount(line)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка в файле пользователей, строка %d: %v", lineNum, err)
+		}
+		accounts[acc.Name] = acc
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка чтения файла пользователей: %v", err)
+	}
+	return accounts, nil
+}
+
+// saveAccounts replaces the credentials file atomically. It is readable by
+// the owner only, since the hashes can be brute-forced offline
+func saveAccounts(accounts map[string]account) error {
+	names := make([]string, 0, len(accounts))
+	for name := range accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	for _, name := range names {
+		builder.WriteString(accounts[name].String() + "\n")
+	}
+
+	tempPath := usersPath + ".tmp"
+	if err := os.WriteFile(tempPath, []byte(builder.String()), 0600); err != nil {
+		return fmt.Errorf("ошибка записи файла пользователей: %v", err)
+	}
+	if err := os.Rename(tempPath, usersPath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("ошибка записи файла пользователей: %v", err)
+	}
+	return nil
+}
+
+// authRequired reports whether clients have to log in
+func authRequired() (bool, error) {
+	accounts, err := loadAccounts()
+	if err != nil {
+		return false, err
+	}
+	return len(accounts) > 0, nil
+}
+
+// authenticate checks a name and password against the credentials file. The
+// file is read on every login, so useradd, userdel and usermod take effect at once
+func authenticate(name, password string) (account, error) {
+	accounts, err := loadAccounts()
+	if err != nil {
+		return account{}, err
+	}
+	acc, ok := accounts[name]
+	if !ok {
+		dummyAccount.matches(password)
+		return account{}, errBadCredentials
+	}
+	if !acc.matches(password) {
+		return account{}, errBadCredentials
+	}
+	return acc, nil
+}
+
+// login asks for a name and password, giving maxLoginTries attempts. It
+// returns the account, or an error if the client gave up or ran out of tries
+func login(scanner *bufio.Scanner, sendMessage func(string)) (account, error) {
+	for try := 1; try <= maxLoginTries; try++ {
+		sendMessage("Введите имя пользователя:")
+		if !scanner.Scan() {
+			return account{}, errors.New("соединение закрыто до входа")
+		}
+		name := strings.TrimSpace(scanner.Text())
+		sendMessage("Введите пароль:")
+		if !scanner.Scan() {
+			return account{}, errors.New("соединение закрыто до входа")
+		}
+		password := scanner.Text()
+
+		acc, err := authenticate(name, password)
+		if err == nil {
+			return acc, nil
+		}
+		if !errors.Is(err, errBadCredentials) {
+			return account{}, err
+		}
+		sendMessage("Неверное имя пользователя или пароль")
+	}
+	return account{}, errors.New("превышено число попыток входа")
+}
+
+// updateAccounts loads the accounts, lets change modify them and saves the
+// result, all under an exclusive lock on a sidecar of the users file, so two
+// useradd, usermod or userdel run at once don't lose each other's change.
+// Logins read the file without the lock: saveAccounts replaces it atomically
+func updateAccounts(change func(accounts map[string]account) error) error {
+	lock := &fileLock{path: usersPath + ".lock"}
+	unlock, err := lock.Lock(true)
+	if err != nil {
+		return fmt.Errorf("ошибка блокировки файла пользователей: %v", err)
+	}
+	defer unlock()
+
+	accounts, err := loadAccounts()
+	if err != nil {
+		return err
+	}
+	if err := change(accounts); err != nil {
+		return err
+	}
+	return saveAccounts(accounts)
+}
+
+func addUser(name, password string, r role) error {
+	if !validUserName.MatchString(name) {
+		return fmt.Errorf("имя пользователя может содержать только латинские буквы, цифры, '_', '.', '-' (до 32 символов)")
+	}
+	if password == "" {
+		return fmt.Errorf("пароль не может быть пустым")
+	}
+	// Хеш вычисляется до блокировки: это самая долгая часть
+	acc, err := newAccount(name, password, r)
+	if err != nil {
+		return err
+	}
+	return updateAccounts(func(accounts map[string]account) error {
+		if _, ok := accounts[name]; ok {
+			return errUserExists
+		}
+		accounts[name] = acc
+		return nil
+	})
+}
+
+func setUserRole(name string, r role) error {
+	return updateAccounts(func(accounts map[string]account) error {
+		acc, ok := accounts[name]
+		if !ok {
+			return errUserNotFound
+		}
+		acc.Role = r
+		accounts[name] = acc
+		return nil
+	})
+}
+
+func removeUser(name string) error {
+	return updateAccounts(func(accounts map[string]account) error {
+		if _, ok := accounts[name]; !ok {
+			return errUserNotFound
+		}
+		delete(accounts, name)
+		return nil
+	})
+}
+
+// runUserAdd implements the "useradd [-role роль] имя" command. The password
+// is read from the first line of standard input so it doesn't end up in the
+// shell history
+func runUserAdd(args []string) int {
+	fs := flag.NewFlagSet("useradd", flag.ExitOnError)
+	roleName := fs.String("role", roleReader.String(), "роль: reader, editor или admin")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println("Использование: useradd [-role reader|editor|admin] имя (пароль читается из стандартного ввода)")
+		return 2
+	}
+	name := fs.Arg(0)
+	r, err := parseRole(*roleName)
+	if err != nil {
+		fmt.Printf("Ошибка: %v\n", err)
+		return 2
+	}
+
+	fmt.Fprintf(os.Stderr, "Пароль для %s: ", name)
+	scanner := bufio.NewScanner(os.Stdin)
+	if !scanner.Scan() {
+		fmt.Println("Ошибка: пароль не введен")
+		return 2
+	}
+	if err := addUser(name, strings.TrimRight(scanner.Text(), "\r"), r); err != nil {
+		fmt.Printf("Ошибка: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Пользователь %s (%s) добавлен\n", name, r)
+	return 0
+}
+
+// runUserMod implements the "usermod -role роль имя" command
+func runUserMod(args []string) int {
+	fs := flag.NewFlagSet("usermod", flag.ExitOnError)
+	roleName := fs.String("role", "", "новая роль: reader, editor или admin")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *roleName == "" {
+		fmt.Println("Использование: usermod -role reader|editor|admin имя")
+		return 2
+	}
+	r, err := parseRole(*roleName)
+	if err != nil {
+		fmt.Printf("Ошибка: %v\n", err)
+		return 2
+	}
+	if err := setUserRole(fs.Arg(0), r); err != nil {
+		fmt.Printf("Ошибка: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Пользователь %s теперь %s\n", fs.Arg(0), r)
+	return 0
+}
+
+// runUserDel implements the "userdel имя" command
+func runUserDel(args []string) int {
+	fs := flag.NewFlagSet("userdel", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println("Использование: userdel имя")
+		return 2
+	}
+	if err := removeUser(fs.Arg(0)); err != nil {
+		fmt.Printf("Ошибка: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Пользователь %s удален\n", fs.Arg(0))
+	return 0
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// useTempUsersFile points usersPath at an empty file in a temporary directory
+func useTempUsersFile(t *testing.T) {
+	saved := usersPath
+	usersPath = filepath.Join(t.TempDir(), "books.users")
+	t.Cleanup(func() { usersPath = saved })
+}
+
+// TestCredentialCacheFollowsUsersFile checks that a cached login stops
+// working as soon as the account is removed or its role changes
+func TestCredentialCacheFollowsUsersFile(t *testing.T) {
+	useTempUsersFile(t)
+	cache := &credentialCache{}
+
+	if err := addUser("anna", "secret", roleEditor); err != nil {
+		t.Fatal(err)
+	}
+	const header = "Basic YW5uYTpzZWNyZXQ="
+	for i := 0; i < 2; i++ {
+		acc, err := cache.authenticate(header, "anna", "secret")
+		if err != nil || acc.Role != roleEditor {
+			t.Fatalf("вход %d: %v, роль %s", i+1, err, acc.Role)
+		}
+	}
+
+	if err := setUserRole("anna", roleReader); err != nil {
+		t.Fatal(err)
+	}
+	if acc, err := cache.authenticate(header, "anna", "secret"); err != nil || acc.Role != roleReader {
+		t.Errorf("после usermod: %v, роль %s, ожидалась %s", err, acc.Role, roleReader)
+	}
+
+	if err := removeUser("anna"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.authenticate(header, "anna", "secret"); !errors.Is(err, errBadCredentials) {
+		t.Errorf("после userdel: %v, ожидалось %v", err, errBadCredentials)
+	}
+}
+
+// TestConcurrentUserChanges checks that accounts added at the same time are
+// all kept
+func TestConcurrentUserChanges(t *testing.T) {
+	useTempUsersFile(t)
+	acc, err := newAccount("", "secret", roleReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, perWriter = 16, 10
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				err := updateAccounts(func(accounts map[string]account) error {
+					acc := acc
+					acc.Name = fmt.Sprintf("user%d_%d", n, j)
+					accounts[acc.Name] = acc
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	accounts, err := loadAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != writers*perWriter {
+		t.Errorf("учетных записей %d, ожидалось %d", len(accounts), writers*perWriter)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Операции, записываемые в журнал
+const (
+	walInsert  = "insert"
+	walReplace = "replace"
+	walRemove  = "remove"
+	// walReplaceAll replaces the whole file, e.g. when a dump is restored
+	walReplaceAll = "replace_all"
+)
+
+// walRecord describes one modification of the books file. Applying a record
+// twice gives the same result, so recovery can simply replay it
+type walRecord struct {
+	Op   string   `json:"op"`
+	Book *Book    `json:"book,omitempty"`
+	IDs  []string `json:"ids,omitempty"`
+	// Books is the new content of the file for walReplaceAll
+	Books []Book `json:"books,omitempty"`
+	// Size is the length of the books file before an insert; replaying
+	// truncates the file back to it so a torn append is overwritten
+	Size int64 `json:"size,omitempty"`
+}
+
+// journal is an append-only write-ahead log. Every line is
+// "<crc32 in hex> <json record>" and is synced to disk before the
+// operation it describes is applied
+type journal struct {
+	path string
+}
+
+func (j *journal) begin(rec walRecord) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("ошибка кодирования записи журнала: %v", err)
+	}
+
+	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия журнала: %v", err)
+	}
+	defer file.Close()
+
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(payload), payload)
+	if _, err := file.WriteString(line); err != nil {
+		return fmt.Errorf("ошибка записи в журнал: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("ошибка синхронизации журнала: %v", err)
+	}
+	return nil
+}
+
+// checkpoint drops the journal once every logged operation has been applied
+func (j *journal) checkpoint() error {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("ошибка очистки журнала: %v", err)
+	}
+	return nil
+}
+
+// records returns the intact records of the journal and the number of
+// records discarded because of a checksum mismatch (a write torn by a crash)
+func (j *journal) records() ([]walRecord, int, error) {
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("ошибка открытия журнала: %v", err)
+	}
+	defer file.Close()
+
+	// Запись replace_all содержит всю базу одной строкой, поэтому длина
+	// строки не ограничивается
+	var records []walRecord
+	torn := 0
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, 0, fmt.Errorf("ошибка чтения журнала: %v", err)
+		}
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if len(line) == 0 {
+			continue
+		}
+
+		sum, payload, ok := bytes.Cut(line, []byte(" "))
+		checksum, parseErr := strconv.ParseUint(string(sum), 16, 32)
+		if !ok || parseErr != nil || uint32(checksum) != crc32.ChecksumIEEE(payload) {
+			torn++
+			continue
+		}
+
+		var rec walRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			torn++
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, torn, nil
+}
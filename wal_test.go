@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestJournalLongRecord checks that a replace_all record of a database far
+// larger than a bufio.Scanner line is read back whole
+func TestJournalLongRecord(t *testing.T) {
+	j := &journal{path: filepath.Join(t.TempDir(), "books.wal")}
+
+	books := make([]Book, 20000)
+	for i := range books {
+		books[i] = benchBook(i + 1)
+	}
+	if err := j.begin(walRecord{Op: walReplaceAll, Books: books}); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.begin(walRecord{Op: walRemove, IDs: []string{"1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(j.path); err != nil || info.Size() < 2*1024*1024 {
+		t.Fatalf("журнал слишком мал для проверки: %v, %v", info, err)
+	}
+
+	records, torn, err := j.records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torn != 0 || len(records) != 2 {
+		t.Fatalf("записей %d, поврежденных %d, ожидалось 2 и 0", len(records), torn)
+	}
+	if got := len(records[0].Books); got != len(books) {
+		t.Errorf("в replace_all %d книг, ожидалось %d", got, len(books))
+	}
+	if records[1].Op != walRemove {
+		t.Errorf("вторая запись %q, ожидалась %q", records[1].Op, walRemove)
+	}
+}
+
+// TestJournalTornTail checks that a record cut off by a crash is counted as
+// torn and the records before it are kept
+func TestJournalTornTail(t *testing.T) {
+	j := &journal{path: filepath.Join(t.TempDir(), "books.wal")}
+	book := benchBook(1)
+	if err := j.begin(walRecord{Op: walInsert, Book: &book}); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(file, `0badc0de {"op":"rem`)
+	file.Close()
+
+	records, torn, err := j.records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || torn != 1 {
+		t.Errorf("записей %d, поврежденных %d, ожидалось 1 и 1", len(records), torn)
+	}
+}
+
+// readBookIDs returns the IDs of the books in s in file order
+func readBookIDs(t *testing.T, s *fileStore) []string {
+	t.Helper()
+	books, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bookIDs(books)
+}
+
+// TestReplayHalfAppliedJournal leaves the journal and the books file as a
+// crash in the middle of each operation would and checks what Recover makes
+// of them
+func TestReplayHalfAppliedJournal(t *testing.T) {
+	silenceLog(t)
+
+	first, second, third := newTestBook("Первая книга"), newTestBook("Вторая книга"), newTestBook("Третья книга")
+	first.ID, second.ID, third.ID = "1", "2", "3"
+	changed := second
+	changed.Score = "7"
+
+	cases := []struct {
+		name  string
+		crash func(t *testing.T, s *fileStore, path string)
+		want  []string
+	}{
+		{
+			// Запись в журнале есть, строка дописана наполовину
+			name: "insert",
+			crash: func(t *testing.T, s *fileStore, path string) {
+				size, err := fileSize(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.wal.begin(walRecord{Op: walInsert, Book: &third, Size: size}); err != nil {
+					t.Fatal(err)
+				}
+				line := bookToLine(third)
+				appendRaw(t, path, line[:len(line)/2])
+			},
+			want: []string{"1", "2", "3"},
+		},
+		{
+			// Запись в журнале есть, временный файл не успели переименовать
+			name: "replace",
+			crash: func(t *testing.T, s *fileStore, path string) {
+				if err := s.wal.begin(walRecord{Op: walReplace, Book: &changed}); err != nil {
+					t.Fatal(err)
+				}
+				appendRaw(t, s.tempPath, formatHeader(currentFormat)+bookToLine(first))
+			},
+			want: []string{"1", "2"},
+		},
+		{
+			// Удаление уже применено, но журнал не очищен: повтор ничего не меняет
+			name: "remove",
+			crash: func(t *testing.T, s *fileStore, path string) {
+				rec := walRecord{Op: walRemove, IDs: []string{"1"}}
+				if err := s.wal.begin(rec); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := s.apply(rec); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"2"},
+		},
+		{
+			// Запись журнала оборвана: операция не применяется
+			name: "torn",
+			crash: func(t *testing.T, s *fileStore, path string) {
+				appendRaw(t, s.wal.path, `0badc0de {"op":"remove","ids":["1"`)
+			},
+			want: []string{"1", "2"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, path := newTempFileStore(t)
+			for _, book := range []Book{first, second} {
+				if err := s.Insert(book); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c.crash(t, s, path)
+
+			if err := newFileStore(path, s.tempPath).Recover(); err != nil {
+				t.Fatal(err)
+			}
+			if got := readBookIDs(t, s); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("после восстановления книги %v, ожидались %v", got, c.want)
+			}
+			if c.name == "replace" {
+				if book, err := s.Get("2"); err != nil || book.Score != "7" {
+					t.Errorf("замена не повторена: %+v, %v", book, err)
+				}
+			}
+			for _, leftover := range []string{s.wal.path, s.tempPath} {
+				if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+					t.Errorf("после восстановления остался %s", filepath.Base(leftover))
+				}
+			}
+			report, err := s.Fsck(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Issues) != 0 {
+				t.Errorf("fsck после восстановления: %+v", report.Issues)
+			}
+		})
+	}
+}
+
+// appendRaw appends text to the file at path, creating it if needed
+func appendRaw(t *testing.T, path, text string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestUndoInsert checks that a failed insert leaves the books file as it was
+// before: cut back to its old size, or absent if there was no file
+func TestUndoInsert(t *testing.T) {
+	s, path := newTempFileStore(t)
+	book := newTestBook("Книга")
+	book.ID = "1"
+	line := formatHeader(currentFormat) + bookToLine(book)
+
+	appendRaw(t, path, line[:len(line)/2])
+	s.undoInsert(0, false)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("после отката первой вставки файл книг остался: %v", err)
+	}
+
+	if err := s.Insert(book); err != nil {
+		t.Fatal(err)
+	}
+	size, err := fileSize(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRaw(t, path, "2|Недописанная")
+	s.undoInsert(size, true)
+	if data, err := os.ReadFile(path); err != nil || string(data) != line {
+		t.Errorf("после отката файл %q, %v, ожидался %q", data, err, line)
+	}
+}